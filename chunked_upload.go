@@ -0,0 +1,260 @@
+package fdfs_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const DEFAULT_CHUNK_SIZE = 4 * 1024 * 1024
+
+// ChunkedUploader uploads a large local file as an appender file, one chunk at a
+// time. After every acknowledged chunk it records its progress in a JSON
+// checkpoint file, so that an upload interrupted by a crash resumes from the last
+// complete chunk instead of starting over.
+type ChunkedUploader struct {
+	client *FdfsClient
+
+	// ChunkSize is the number of bytes sent per request.
+	ChunkSize int64
+	// CheckpointPath is where the progress of the upload of localFilename is
+	// kept; it defaults to localFilename + ".fdfs_upload".
+	CheckpointPath string
+	// Progress, if set, is called after every chunk with the bytes stored so far,
+	// and once with those of the checkpoint when an upload resumes.
+	Progress func(uploaded int64, total int64)
+	// Regenerate turns the finished appender file into a normal file, see
+	// FdfsClient.RegenerateAppenderFilename.
+	Regenerate bool
+}
+
+// uploadCheckpoint is the JSON content of a checkpoint file.
+type uploadCheckpoint struct {
+	LocalFilename string `json:"local_filename"`
+	FileSize      int64  `json:"file_size"`
+	ModTime       int64  `json:"mod_time"`
+	ChunkSize     int64  `json:"chunk_size"`
+	RemoteFileId  string `json:"remote_file_id"`
+	Uploaded      int64  `json:"uploaded"`
+	// Regenerating is set before the appender file is regenerated, which
+	// renames it, and RegeneratedFileId once the new file id is known.
+	Regenerating      bool   `json:"regenerating,omitempty"`
+	RegeneratedFileId string `json:"regenerated_file_id,omitempty"`
+}
+
+func NewChunkedUploader(client *FdfsClient, chunkSize int64) *ChunkedUploader {
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	return &ChunkedUploader{client: client, ChunkSize: chunkSize}
+}
+
+func (this *ChunkedUploader) Upload(localFilename string, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadContext(context.Background(), localFilename, fileExtName)
+}
+
+// UploadContext uploads localFilename, resuming from its checkpoint when one
+// exists for the same file content, and removes the checkpoint once done.
+func (this *ChunkedUploader) UploadContext(ctx context.Context, localFilename string, fileExtName string) (*UploadFileResponse, error) {
+	if this.ChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", this.ChunkSize)
+	}
+	file, fileSize, err := openUploadFile(localFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	checkpointPath := this.checkpointPath(localFilename)
+	cp := &uploadCheckpoint{
+		LocalFilename: localFilename,
+		FileSize:      fileSize,
+		ModTime:       stat.ModTime().UnixNano(),
+		ChunkSize:     this.ChunkSize,
+	}
+	if saved, err := loadUploadCheckpoint(checkpointPath); err != nil {
+		return nil, err
+	} else if saved != nil && saved.matches(cp) {
+		cp = saved
+		if cp.RegeneratedFileId == "" {
+			if err = this.resume(ctx, cp); err != nil {
+				return nil, err
+			}
+		}
+		if cp.RemoteFileId != "" && this.Progress != nil {
+			this.Progress(cp.Uploaded, cp.FileSize)
+		}
+	}
+
+	if cp.RemoteFileId == "" {
+		size := minInt64(this.ChunkSize, fileSize)
+		ur, err := this.client.UploadAppenderByReaderContext(ctx, io.NewSectionReader(file, 0, size), size, fileExtName)
+		if err != nil {
+			return nil, err
+		}
+		cp.RemoteFileId = ur.RemoteFileId
+		cp.Uploaded = size
+		if err = this.saveProgress(checkpointPath, cp); err != nil {
+			return nil, err
+		}
+	}
+
+	for cp.Uploaded < fileSize {
+		size := minInt64(this.ChunkSize, fileSize-cp.Uploaded)
+		newSize, err := this.client.AppendByReaderContext(ctx, io.NewSectionReader(file, cp.Uploaded, size), size, cp.RemoteFileId)
+		if err != nil {
+			return nil, err
+		}
+		if newSize != cp.Uploaded+size {
+			return nil, fmt.Errorf("appender file %s has %d bytes after append, want %d", cp.RemoteFileId, newSize, cp.Uploaded+size)
+		}
+		cp.Uploaded = newSize
+		if err = this.saveProgress(checkpointPath, cp); err != nil {
+			return nil, err
+		}
+	}
+
+	remoteFileId := cp.RemoteFileId
+	if this.Regenerate || cp.RegeneratedFileId != "" {
+		if cp.RegeneratedFileId == "" {
+			if err = this.regenerate(ctx, checkpointPath, cp); err != nil {
+				return nil, err
+			}
+		}
+		remoteFileId = cp.RegeneratedFileId
+	}
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	ur := &UploadFileResponse{GroupName: fileId.GroupName, RemoteFileId: remoteFileId}
+	if err = os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+		this.client.config.Logger.Warnf("remove checkpoint %s error :%s", checkpointPath, err.Error())
+	}
+	return ur, nil
+}
+
+// regenerate turns the appender file of cp into a normal file, recording in the
+// checkpoint that it started and the new file id, so that a crash in between
+// does not lead to uploading the file again.
+func (this *ChunkedUploader) regenerate(ctx context.Context, checkpointPath string, cp *uploadCheckpoint) error {
+	cp.Regenerating = true
+	if err := cp.save(checkpointPath); err != nil {
+		return err
+	}
+	ur, err := this.client.RegenerateAppenderFilenameContext(ctx, cp.RemoteFileId)
+	if err != nil {
+		return err
+	}
+	cp.RegeneratedFileId = ur.RemoteFileId
+	if err = cp.save(checkpointPath); err != nil {
+		this.client.config.Logger.Warnf("save checkpoint %s error :%s", checkpointPath, err.Error())
+	}
+	return nil
+}
+
+// resume checks the appender file of cp against the checkpoint and cuts off
+// whatever lies beyond the last complete chunk.
+func (this *ChunkedUploader) resume(ctx context.Context, cp *uploadCheckpoint) error {
+	if cp.RemoteFileId == "" {
+		return nil
+	}
+	fileId, err := ParseFileID(cp.RemoteFileId)
+	if err != nil {
+		return err
+	}
+	info, err := this.client.QueryFileInfoContext(ctx, fileId.GroupName, fileId.Filename())
+	if errno, ok := err.(Errno); ok && errno.status == 2 && cp.Regenerating {
+		// regenerated before the new file id could be saved
+		return fmt.Errorf("appender file %s was regenerated under an unknown file id", cp.RemoteFileId)
+	} else if ok && errno.status == 2 {
+		this.client.config.Logger.Warnf("appender file %s is gone, restarting upload", cp.RemoteFileId)
+		cp.RemoteFileId = ""
+		cp.Uploaded = 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	remoteSize := info.FileSize
+	confirmed := remoteSize
+	if confirmed != cp.FileSize {
+		confirmed -= confirmed % cp.ChunkSize
+	}
+	if confirmed > cp.FileSize {
+		confirmed = cp.FileSize - cp.FileSize%cp.ChunkSize
+	}
+	if confirmed != remoteSize {
+		if _, err = this.client.TruncAppenderByFilenameContext(ctx, cp.RemoteFileId, confirmed); err != nil {
+			return err
+		}
+	}
+	cp.Uploaded = confirmed
+	return nil
+}
+
+func (this *ChunkedUploader) checkpointPath(localFilename string) string {
+	if this.CheckpointPath != "" {
+		return this.CheckpointPath
+	}
+	return localFilename + ".fdfs_upload"
+}
+
+func (this *ChunkedUploader) saveProgress(checkpointPath string, cp *uploadCheckpoint) error {
+	if err := cp.save(checkpointPath); err != nil {
+		return err
+	}
+	if this.Progress != nil {
+		this.Progress(cp.Uploaded, cp.FileSize)
+	}
+	return nil
+}
+
+// matches reports whether the checkpoint was written for the same local file
+// content and chunk size.
+func (this *uploadCheckpoint) matches(other *uploadCheckpoint) bool {
+	return this.LocalFilename == other.LocalFilename && this.FileSize == other.FileSize &&
+		this.ModTime == other.ModTime && this.ChunkSize == other.ChunkSize
+}
+
+// save replaces the checkpoint file atomically.
+func (this *uploadCheckpoint) save(path string) error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadUploadCheckpoint returns nil without error when there is no checkpoint.
+func loadUploadCheckpoint(path string) (*uploadCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cp := &uploadCheckpoint{}
+	if err = json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid upload checkpoint %s: %s", path, err.Error())
+	}
+	return cp, nil
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,47 +1,48 @@
 package fdfs_client
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"runtime"
-	/*"strconv"
-	"strings"*/
+	"strconv"
+	"sync"
+	"time"
+	/*"strings"*/
 
 	"github.com/Sirupsen/logrus"
 )
 
 var (
-	logger                                          = logrus.New()
-	storagePoolChan      chan *storagePool          = make(chan *storagePool, 1)
-	storagePoolMap       map[string]*ConnectionPool = make(map[string]*ConnectionPool)
-	fetchStoragePoolChan chan interface{}           = make(chan interface{}, 1)
-	quit                 chan bool
+	logger = logrus.New()
 )
 
+// FdfsClient talks to a FastDFS cluster through its trackers. Every operation
+// has a ...Context variant that aborts dialing and network I/O once the context
+// is done and then returns ctx.Err(). Downloads fail over to other replicas and
+// uploads to other storage servers as set by WithRetryPolicy and WithUploadRetryPolicy.
 type FdfsClient struct {
 	tracker     *Tracker
 	trackerPool *ConnectionPool
-	timeout     int
+	config      ClientConfig
+
+	mu           sync.Mutex
+	storagePools map[string]*ConnectionPool // by host:port, nil once closed
+	closed       bool
+	calls        sync.WaitGroup
 }
 
+// callKey marks the context of a call in progress, see begin.
+type callKey struct{}
+
 type Tracker struct {
 	HostList []string
 	Ports    []int
 }
-type storagePool struct {
-	storagePoolKey string
-	hosts          []string
-	ports          []int
-	minConns       int
-	maxConns       int
-}
-
-/*func (storagePool storagePool) Print() {
-	logger.Info("storagePoolKey:" + storagePool.storagePoolKey)
-	logger.Info("hosts" + storagePool.hosts[0])
-	logger.Info("ports" + storagePool.ports[0])
-}*/
 
 func init() {
 	logger.Formatter = new(logrus.TextFormatter)
@@ -56,34 +57,6 @@ func init() {
 	}).Info("A group of walrus emerges from the ocean")*/
 	//logger.Info("A group of walrus emerges from the ocean")
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	go func() {
-		// start a loop
-		for {
-			select {
-			case spd := <-storagePoolChan:
-				if sp, ok := storagePoolMap[spd.storagePoolKey]; ok {
-					logger.Debug("storagePool already exist")
-					fetchStoragePoolChan <- sp
-				} else {
-					var (
-						sp  *ConnectionPool
-						err error
-					)
-					logger.Debug("starting a new storagePool")
-					sp, err = NewConnectionPool(spd.hosts, spd.ports, spd.minConns, spd.maxConns)
-					//defer sp.Close()
-					if err != nil {
-						fetchStoragePoolChan <- err
-					} else {
-						storagePoolMap[spd.storagePoolKey] = sp
-						fetchStoragePoolChan <- sp
-					}
-				}
-			case <-quit:
-				break
-			}
-		}
-	}()
 }
 func getTrackerConf(ConfPath string) (*Tracker, error) {
 	Config := &Config{}
@@ -100,218 +73,518 @@ func getTrackerConf(ConfPath string) (*Tracker, error) {
 	return tracer, nil
 }
 
-func NewFdfsClient(confPath string) (*FdfsClient, error) {
-	tracker, err := getTrackerConf(confPath)
+// NewFdfsClient creates a client with the settings of client.conf at confPath;
+// opts override them.
+func NewFdfsClient(confPath string, opts ...ClientOption) (*FdfsClient, error) {
+	config, err := getConf(confPath)
 	if err != nil {
 		return nil, err
 	}
+	return NewFdfsClientByConfig(config, opts...)
+}
 
-	trackerPool, err := NewConnectionPool(tracker.HostList, tracker.Ports, MINCONN, MAXCONN)
-	if err != nil {
+// NewFdfsClientByConfig creates a client with the settings of config, e.g. one
+// made by LoadConfig or filled in by hand starting from DefaultConfig; opts
+// override them.
+func NewFdfsClientByConfig(config *Config, opts ...ClientOption) (*FdfsClient, error) {
+	if err := config.Validate(); err != nil {
 		return nil, err
 	}
+	tracker := &Tracker{
+		HostList: config.TrackerIp,
+		Ports:    config.TrackerPort,
+	}
+	clientConfig := DefaultClientConfig()
+	clientConfig.MinConns = config.MinConn
+	clientConfig.MaxConns = config.MaxConn
+	clientConfig.ConnectTimeout = secondsOrDefault(config.Con_Timeout, DEFAULT_CONNECT_TIMEOUT)
+	clientConfig.NetworkTimeout = secondsOrDefault(config.Net_Timeout, DEFAULT_NETWORK_TIMEOUT)
+	if config.UseStorageId {
+		var err error
+		if clientConfig.StorageIds, err = LoadStorageIds(config.StorageIdsFilename); err != nil {
+			return nil, err
+		}
+	}
+	clientConfig.apply(opts)
+
+	return newFdfsClient(tracker, clientConfig)
+}
+
+// secondsOrDefault converts a timeout from client.conf, where a value <= 0 means the default.
+func secondsOrDefault(seconds int, def time.Duration) time.Duration {
+	if seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
 
-	return &FdfsClient{tracker: tracker, trackerPool: trackerPool}, nil
+// NewFdfsClientByTracker creates a client for the trackers of tracker with
+// DefaultClientConfig changed by opts.
+func NewFdfsClientByTracker(tracker *Tracker, opts ...ClientOption) (*FdfsClient, error) {
+	clientConfig := DefaultClientConfig()
+	clientConfig.apply(opts)
+	return newFdfsClient(tracker, clientConfig)
 }
 
-func NewFdfsClientByTracker(tracker *Tracker) (*FdfsClient, error) {
-	trackerPool, err := NewConnectionPool(tracker.HostList, tracker.Ports, MINCONN, MAXCONN)
+func newFdfsClient(tracker *Tracker, config ClientConfig) (*FdfsClient, error) {
+	trackerPool, err := config.newPool(tracker.HostList, tracker.Ports)
 	if err != nil {
 		return nil, err
 	}
 
-	return &FdfsClient{tracker: tracker, trackerPool: trackerPool}, nil
+	return &FdfsClient{
+		tracker:      tracker,
+		trackerPool:  trackerPool,
+		config:       config,
+		storagePools: make(map[string]*ConnectionPool),
+	}, nil
+}
+
+// Close stops the client from accepting calls, waits for the calls in progress
+// to finish and closes its tracker and storage connection pools. Calls made
+// after Close return ErrClosed.
+func (this *FdfsClient) Close() {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return
+	}
+	this.closed = true
+	this.mu.Unlock()
+
+	this.calls.Wait()
+
+	this.mu.Lock()
+	pools := this.storagePools
+	this.storagePools = nil
+	this.mu.Unlock()
+	for _, pool := range pools {
+		pool.Close()
+	}
+	this.trackerPool.Close()
 }
-func ColseFdfsClient() {
-	quit <- true
+
+// begin registers a call so that Close waits for it and returns the context
+// to pass on and the function to call when done. Calls made on behalf of a
+// call in progress are part of it.
+func (this *FdfsClient) begin(ctx context.Context) (context.Context, func(), error) {
+	if ctx.Value(callKey{}) == this {
+		return ctx, func() {}, nil
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return nil, nil, ErrClosed
+	}
+	this.calls.Add(1)
+	return context.WithValue(ctx, callKey{}, this), this.calls.Done, nil
 }
 
 func (this *FdfsClient) UploadByFilename(filename string) (*UploadFileResponse, error) {
+	return this.UploadByFilenameContext(context.Background(), filename)
+}
+
+func (this *FdfsClient) UploadByFilenameContext(ctx context.Context, filename string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
 	if err := fdfsCheckFile(filename); err != nil {
-		logger.Error("fdfsCheckFile error" + err.Error())
+		this.config.Logger.Error("fdfsCheckFile error" + err.Error())
 		return nil, errors.New(err.Error() + "(uploading)")
 	}
 
+	var ur *UploadFileResponse
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
+	_, err = this.withStoreFailover(ctx, tc, "", nil,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			ur, err = store.storageUploadByFilename(ctx, tc, storeServ, filename)
+			return err
+		})
 	if err != nil {
 		return nil, err
 	}
-
-	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
-
-	return store.storageUploadByFilename(tc, storeServ, filename)
+	return ur, nil
 }
 
 func (this *FdfsClient) UploadByBuffer(filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadByBufferContext(context.Background(), filebuffer, fileExtName)
+}
+
+func (this *FdfsClient) UploadByBufferContext(ctx context.Context, filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	var ur *UploadFileResponse
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
+	_, err = this.withStoreFailover(ctx, tc, "", nil,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			ur, err = store.storageUploadByBuffer(ctx, tc, storeServ, filebuffer, fileExtName)
+			return err
+		})
 	if err != nil {
 		return nil, err
 	}
+	return ur, nil
+}
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
+// UploadByReader uploads exactly size bytes read from r, streaming them to the
+// storage server instead of buffering the whole file.
+func (this *FdfsClient) UploadByReader(r io.Reader, size int64, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadByReaderContext(context.Background(), r, size, fileExtName)
+}
+
+func (this *FdfsClient) UploadByReaderContext(ctx context.Context, r io.Reader, size int64, fileExtName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
 
-	return store.storageUploadByBuffer(tc, storeServ, filebuffer, fileExtName)
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size %d", size)
+	}
+
+	rr := newReplayableReader(r)
+	var ur *UploadFileResponse
+	tc := &TrackerClient{this.trackerPool}
+	_, err = this.withStoreFailover(ctx, tc, "", rr.canReplay,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			if err = rr.replay(); err != nil {
+				return err
+			}
+			ur, err = store.storageUploadByReader(ctx, tc, storeServ, rr.reader, size, fileExtName)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ur, nil
 }
 
-func (this *FdfsClient) UploadSlaveByFilename(filename, remoteFileId, prefixName string) (*UploadFileResponse, error) {
+// UploadByFilenameWithMetadata uploads filename and attaches metaData to it on the same
+// storage server. If rollback is set and the metadata cannot be stored, the new file is deleted.
+func (this *FdfsClient) UploadByFilenameWithMetadata(filename string, metaData map[string]string, rollback bool) (*UploadFileResponse, error) {
+	return this.UploadByFilenameWithMetadataContext(context.Background(), filename, metaData, rollback)
+}
+
+func (this *FdfsClient) UploadByFilenameWithMetadataContext(ctx context.Context, filename string, metaData map[string]string, rollback bool) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
 	if err := fdfsCheckFile(filename); err != nil {
+		this.config.Logger.Error("fdfsCheckFile error" + err.Error())
 		return nil, errors.New(err.Error() + "(uploading)")
 	}
-
-	tmp, err := splitRemoteFileId(remoteFileId)
-	if err != nil || len(tmp) != 2 {
+	if _, err := packMetadata(metaData); err != nil {
 		return nil, err
 	}
-	groupName := tmp[0]
-	remoteFilename := tmp[1]
 
+	var (
+		ur    *UploadFileResponse
+		store *StorageClient
+	)
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageStorWithGroup(groupName)
+	storeServ, err := this.withStoreFailover(ctx, tc, "", nil,
+		func(sc *StorageClient, storeServ *StorageServer) (err error) {
+			store = sc
+			ur, err = sc.storageUploadByFilename(ctx, tc, storeServ, filename)
+			return err
+		})
 	if err != nil {
 		return nil, err
 	}
+	return store.storageSetUploadMetadata(ctx, tc, storeServ, ur, metaData, rollback)
+}
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
-
-	return store.storageUploadSlaveByFilename(tc, storeServ, filename, prefixName, remoteFilename)
+// UploadByBufferWithMetadata is like UploadByFilenameWithMetadata but uploads filebuffer.
+func (this *FdfsClient) UploadByBufferWithMetadata(filebuffer []byte, fileExtName string, metaData map[string]string, rollback bool) (*UploadFileResponse, error) {
+	return this.UploadByBufferWithMetadataContext(context.Background(), filebuffer, fileExtName, metaData, rollback)
 }
 
-func (this *FdfsClient) UploadSlaveByBuffer(filebuffer []byte, remoteFileId, fileExtName string) (*UploadFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
-	if err != nil || len(tmp) != 2 {
+func (this *FdfsClient) UploadByBufferWithMetadataContext(ctx context.Context, filebuffer []byte, fileExtName string, metaData map[string]string, rollback bool) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	if _, err := packMetadata(metaData); err != nil {
 		return nil, err
 	}
-	groupName := tmp[0]
-	remoteFilename := tmp[1]
 
+	var (
+		ur    *UploadFileResponse
+		store *StorageClient
+	)
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageStorWithGroup(groupName)
+	storeServ, err := this.withStoreFailover(ctx, tc, "", nil,
+		func(sc *StorageClient, storeServ *StorageServer) (err error) {
+			store = sc
+			ur, err = sc.storageUploadByBuffer(ctx, tc, storeServ, filebuffer, fileExtName)
+			return err
+		})
 	if err != nil {
 		return nil, err
 	}
+	return store.storageSetUploadMetadata(ctx, tc, storeServ, ur, metaData, rollback)
+}
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
-
-	return store.storageUploadSlaveByBuffer(tc, storeServ, filebuffer, remoteFilename, fileExtName)
+func (this *FdfsClient) UploadSlaveByFilename(filename, remoteFileId, prefixName string) (*UploadFileResponse, error) {
+	return this.UploadSlaveByFilenameContext(context.Background(), filename, remoteFileId, prefixName)
 }
 
-func (this *FdfsClient) UploadAppenderByFilename(filename string) (*UploadFileResponse, error) {
+func (this *FdfsClient) UploadSlaveByFilenameContext(ctx context.Context, filename, remoteFileId, prefixName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
 	if err := fdfsCheckFile(filename); err != nil {
 		return nil, errors.New(err.Error() + "(uploading)")
 	}
 
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
+	storeServ, err := tc.trackerQueryStorageStorWithGroup(ctx, groupName)
 	if err != nil {
 		return nil, err
 	}
 
 	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
+	if err != nil {
+		return nil, err
+	}
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
 
-	return store.storageUploadAppenderByFilename(tc, storeServ, filename)
+	return store.storageUploadSlaveByFilename(ctx, tc, storeServ, filename, prefixName, remoteFilename)
 }
 
-func (this *FdfsClient) UploadAppenderByBuffer(filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+func (this *FdfsClient) UploadSlaveByBuffer(filebuffer []byte, remoteFileId, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadSlaveByBufferContext(context.Background(), filebuffer, remoteFileId, fileExtName)
+}
+
+func (this *FdfsClient) UploadSlaveByBufferContext(ctx context.Context, filebuffer []byte, remoteFileId, fileExtName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
+	storeServ, err := tc.trackerQueryStorageStorWithGroup(ctx, groupName)
 	if err != nil {
 		return nil, err
 	}
 
 	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
+	if err != nil {
+		return nil, err
+	}
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
 
-	return store.storageUploadAppenderByBuffer(tc, storeServ, filebuffer, fileExtName)
+	return store.storageUploadSlaveByBuffer(ctx, tc, storeServ, filebuffer, remoteFilename, fileExtName)
 }
 
-func (this *FdfsClient) DeleteFile(remoteFileId string) (*DeleteFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
-	if err != nil || len(tmp) != 2 {
+func (this *FdfsClient) UploadSlaveByReader(r io.Reader, size int64, remoteFileId, prefixName, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadSlaveByReaderContext(context.Background(), r, size, remoteFileId, prefixName, fileExtName)
+}
+
+func (this *FdfsClient) UploadSlaveByReaderContext(ctx context.Context, r io.Reader, size int64, remoteFileId, prefixName, fileExtName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size %d", size)
+	}
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
 		return nil, err
 	}
-	groupName := tmp[0]
-	remoteFilename := tmp[1]
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
 
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFilename)
+	storeServ, err := tc.trackerQueryStorageStorWithGroup(ctx, groupName)
 	if err != nil {
 		return nil, err
 	}
 
 	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
+	if err != nil {
+		return nil, err
+	}
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
 
-	return store.storageDeleteFile(tc, storeServ, remoteFilename)
+	return store.storageUploadSlaveByReader(ctx, tc, storeServ, r, size, prefixName, remoteFilename, fileExtName)
 }
 
-func (this *FdfsClient) DownloadToFile(localFilename string, remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
-	if err != nil || len(tmp) != 2 {
+func (this *FdfsClient) UploadAppenderByFilename(filename string) (*UploadFileResponse, error) {
+	return this.UploadAppenderByFilenameContext(context.Background(), filename)
+}
+
+func (this *FdfsClient) UploadAppenderByFilenameContext(ctx context.Context, filename string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
 		return nil, err
 	}
-	groupName := tmp[0]
-	remoteFilename := tmp[1]
+	defer end()
+
+	if err := fdfsCheckFile(filename); err != nil {
+		return nil, errors.New(err.Error() + "(uploading)")
+	}
 
+	var ur *UploadFileResponse
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageFetch(groupName, remoteFilename)
+	_, err = this.withStoreFailover(ctx, tc, "", nil,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			ur, err = store.storageUploadAppenderByFilename(ctx, tc, storeServ, filename)
+			return err
+		})
 	if err != nil {
 		return nil, err
 	}
+	return ur, nil
+}
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
+func (this *FdfsClient) UploadAppenderByBuffer(filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadAppenderByBufferContext(context.Background(), filebuffer, fileExtName)
+}
+
+func (this *FdfsClient) UploadAppenderByBufferContext(ctx context.Context, filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
 
-	return store.storageDownloadToFile(tc, storeServ, localFilename, offset, downloadSize, remoteFilename)
+	var ur *UploadFileResponse
+	tc := &TrackerClient{this.trackerPool}
+	_, err = this.withStoreFailover(ctx, tc, "", nil,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			ur, err = store.storageUploadAppenderByBuffer(ctx, tc, storeServ, filebuffer, fileExtName)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ur, nil
 }
-func (this *FdfsClient) QueryFileInfo(groupName string, remoteFileName string) (*fileInfo, error) {
+
+func (this *FdfsClient) UploadAppenderByReader(r io.Reader, size int64, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadAppenderByReaderContext(context.Background(), r, size, fileExtName)
+}
+
+func (this *FdfsClient) UploadAppenderByReaderContext(ctx context.Context, r io.Reader, size int64, fileExtName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size %d", size)
+	}
+
+	rr := newReplayableReader(r)
+	var ur *UploadFileResponse
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageFetch(groupName, remoteFileName)
+	_, err = this.withStoreFailover(ctx, tc, "", rr.canReplay,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			if err = rr.replay(); err != nil {
+				return err
+			}
+			ur, err = store.storageUploadAppenderByReader(ctx, tc, storeServ, rr.reader, size, fileExtName)
+			return err
+		})
 	if err != nil {
 		return nil, err
 	}
+	return ur, nil
+}
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
-	return store.storageQueryFileInfo(groupName, remoteFileName)
+// CreateLink returns a new file id for the content of sourceFileId without
+// sending the bytes again. A non-empty prefixName names the link as a slave of
+// sourceFileId, like UploadSlaveByFilename does.
+func (this *FdfsClient) CreateLink(sourceFileId string, fileExtName string, prefixName string) (*UploadFileResponse, error) {
+	return this.CreateLinkContext(context.Background(), sourceFileId, fileExtName, prefixName)
 }
-func (this *FdfsClient) DownloadToBuffer(remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
-	if err != nil || len(tmp) != 2 {
+
+func (this *FdfsClient) CreateLinkContext(ctx context.Context, sourceFileId string, fileExtName string, prefixName string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(sourceFileId)
+	if err != nil {
 		return nil, err
 	}
-	groupName := tmp[0]
-	remoteFilename := tmp[1]
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
 
 	tc := &TrackerClient{this.trackerPool}
-	storeServ, err := tc.trackerQueryStorageFetch(groupName, remoteFilename)
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFilename)
 	if err != nil {
 		return nil, err
 	}
 
 	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
-	store := &StorageClient{storagePool}
+	if err != nil {
+		return nil, err
+	}
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
 
-	var fileBuffer []byte
-	return store.storageDownloadToBuffer(tc, storeServ, fileBuffer, offset, downloadSize, remoteFilename)
+	return store.storageCreateLink(ctx, tc, storeServ, remoteFilename, prefixName, fileExtName)
 }
-func (this *FdfsClient) TruncAppenderByFilename(remoteFileId string, truncatedFileSize int64) (*DeleteFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
-	if err != nil || len(tmp) != 2 {
+
+func (this *FdfsClient) DeleteFile(remoteFileId string) (*DeleteFileResponse, error) {
+	return this.DeleteFileContext(context.Background(), remoteFileId)
+}
+
+func (this *FdfsClient) DeleteFileContext(ctx context.Context, remoteFileId string) (*DeleteFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
 		return nil, err
 	}
-	groupName := tmp[0]
-	remoteFilename := tmp[1]
+	defer end()
 
-	tc := &TrackerClient{this.trackerPool}
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
 
-	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFilename)
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -320,76 +593,807 @@ func (this *FdfsClient) TruncAppenderByFilename(remoteFileId string, truncatedFi
 	if err != nil {
 		return nil, err
 	}
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
 
-	store := &StorageClient{storagePool}
+	return store.storageDeleteFile(ctx, tc, storeServ, remoteFilename)
+}
 
-	return store.storageTruncateFile(tc, storeServ, remoteFilename, truncatedFileSize)
+func (this *FdfsClient) DownloadToFile(localFilename string, remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	return this.DownloadToFileContext(context.Background(), localFilename, remoteFileId, offset, downloadSize)
 }
-func (this *FdfsClient) AppendByFileName(localFileName string, groupName string, remoteFileName string) error {
+
+func (this *FdfsClient) DownloadToFileContext(ctx context.Context, localFilename string, remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	var dr *DownloadFileResponse
 	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := this.withFetchFailover(ctx, tc, groupName, remoteFilename,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			dr, err = store.storageDownloadToFile(ctx, tc, storeServ, localFilename, offset, downloadSize, remoteFilename)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	dr.StorageServer = storeServ
+	return dr, nil
+}
+
+// DownloadToFileResumable downloads remoteFileId into localFilename + ".part"
+// and renames it to localFilename once its size and, unless it is an appender
+// or slave file, its CRC32 match the storage server's. If a previous call left
+// a .part file behind, the download continues after the bytes it already holds;
+// it is deleted only when its CRC32 is wrong.
+func (this *FdfsClient) DownloadToFileResumable(localFilename string, remoteFileId string) (*DownloadFileResponse, error) {
+	return this.DownloadToFileResumableContext(context.Background(), localFilename, remoteFileId)
+}
 
-	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFileName)
+func (this *FdfsClient) DownloadToFileResumableContext(ctx context.Context, localFilename string, remoteFileId string) (*DownloadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer end()
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	fileId, err := ParseFileID(remoteFileId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	info, err := this.QueryFileInfoContext(ctx, fileId.GroupName, fileId.Filename())
+	if err != nil {
+		return nil, err
+	}
+
+	partFilename := localFilename + ".part"
+	file, err := os.OpenFile(partFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	existing, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if existing > info.FileSize {
+		// not a prefix of this file, start over
+		if err = file.Truncate(0); err != nil {
+			return nil, err
+		}
+		if existing, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	dr := &DownloadFileResponse{}
+	if existing < info.FileSize {
+		if dr, err = this.DownloadToWriterContext(ctx, remoteFileId, file, existing, info.FileSize-existing); err != nil {
+			return nil, err
+		}
+	}
+	if err = verifyLocalFile(file, info, fileId.hasChecksum()); err != nil {
+		if _, ok := err.(*ErrChecksumMismatch); ok {
+			// the .part file cannot be trusted any more
+			file.Close()
+			os.Remove(partFilename)
+		}
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(partFilename, localFilename); err != nil {
+		return nil, err
 	}
 
-	store := &StorageClient{storagePool}
-	return store.storageAppendByfileName(tc, storeServ, localFileName, groupName, remoteFileName)
+	dr.RemoteFileId = remoteFileId
+	dr.Content = localFilename
+	dr.DownloadSize = info.FileSize
+	return dr, nil
+}
+
+func (this *FdfsClient) QueryFileInfo(groupName string, remoteFileName string) (*FileInfo, error) {
+	return this.QueryFileInfoContext(context.Background(), groupName, remoteFileName)
 }
-func (this *FdfsClient) ModifyByFileName(localFileName string, offset int64, groupName string, remoteFileName string) error {
-	tc := &TrackerClient{this.trackerPool}
 
-	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFileName)
+func (this *FdfsClient) QueryFileInfoContext(ctx context.Context, groupName string, remoteFileName string) (*FileInfo, error) {
+	ctx, end, err := this.begin(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer end()
+
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := tc.trackerQueryStorageFetch(ctx, groupName, remoteFileName)
+	if err != nil {
+		return nil, err
 	}
 
 	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+	return store.storageQueryFileInfo(ctx, groupName, remoteFileName)
+}
 
-	store := &StorageClient{storagePool}
-	return store.storageModifyByfileName(tc, storeServ, localFileName, offset, groupName, remoteFileName)
+// GetFileInfo returns the file info encoded in remoteFileId without contacting
+// a server. For appender, trunk and slave files, whose names do not describe
+// their current content, it asks the storage server instead. A source storage
+// id is resolved to its IP address through the storage ids of the client.
+func (this *FdfsClient) GetFileInfo(remoteFileId string) (*FileInfo, error) {
+	return this.GetFileInfoContext(context.Background(), remoteFileId)
 }
 
-func (this *FdfsClient) getStoragePool(ipAddr string, port int) (*ConnectionPool, error) {
-	hosts := []string{ipAddr}
-	ports := []int{port}
-	var (
-		storagePoolKey string = fmt.Sprintf("%s-%d", hosts[0], ports[0])
-		result         interface{}
-		err            error
-		ok             bool
-	)
+func (this *FdfsClient) GetFileInfoContext(ctx context.Context, remoteFileId string) (*FileInfo, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
 
-	spd := &storagePool{
-		storagePoolKey: storagePoolKey,
-		hosts:          hosts,
-		ports:          ports,
-		minConns:       MINCONN,
-		maxConns:       MAXCONN,
-	}
-	storagePoolChan <- spd
-	for {
-		select {
-		case result = <-fetchStoragePoolChan:
-			var storagePool *ConnectionPool
-			if err, ok = result.(error); ok {
-				logger.Error("failed to open connection pool" + err.Error())
-				return nil, err
-			} else if storagePool, ok = result.(*ConnectionPool); ok {
-				return storagePool, nil
-			} else {
-				Err := errors.New("none operatoin on storagePool yet")
-				logger.Error(Err.Error())
-				return nil, Err
-			}
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	info := fileId.fileInfo()
+	if info.IsAppender || info.IsTrunk || info.IsSlave {
+		stored, err := this.QueryFileInfoContext(ctx, groupName, remoteFilename)
+		if err != nil {
+			return nil, err
+		}
+		stored.SourceStorageId = info.SourceStorageId
+		stored.IsAppender = info.IsAppender
+		stored.IsTrunk = info.IsTrunk
+		stored.IsSlave = info.IsSlave
+		info = stored
+	}
+	if info.SourceIpAddr == "" && info.SourceStorageId != "" && this.config.StorageIds != nil {
+		if source, ok := this.config.StorageIds.ById(info.SourceStorageId); ok {
+			info.SourceIpAddr = source.IpAddr()
 		}
 	}
+	return info, nil
+}
+
+func (this *FdfsClient) DownloadToBuffer(remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	return this.DownloadToBufferContext(context.Background(), remoteFileId, offset, downloadSize)
+}
+
+func (this *FdfsClient) DownloadToBufferContext(ctx context.Context, remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	var (
+		dr         *DownloadFileResponse
+		fileBuffer []byte
+	)
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := this.withFetchFailover(ctx, tc, groupName, remoteFilename,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			dr, err = store.storageDownloadToBuffer(ctx, tc, storeServ, fileBuffer, offset, downloadSize, remoteFilename)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	dr.StorageServer = storeServ
+	return dr, nil
+}
+
+// DownloadToWriter streams the requested range of remoteFileId into w without
+// holding it in memory. A downloadSize of 0 means up to the end of the file.
+func (this *FdfsClient) DownloadToWriter(remoteFileId string, w io.Writer, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	return this.DownloadToWriterContext(context.Background(), remoteFileId, w, offset, downloadSize)
+}
+
+func (this *FdfsClient) DownloadToWriterContext(ctx context.Context, remoteFileId string, w io.Writer, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	// a retry resumes after the bytes that already reached w
+	cw := &countingWriter{w: w}
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := this.withFetchFailover(ctx, tc, groupName, remoteFilename,
+		func(store *StorageClient, storeServ *StorageServer) error {
+			size := downloadSize
+			if size > 0 {
+				size -= cw.n
+			}
+			_, err := store.storageDownloadToWriter(ctx, tc, storeServ, cw, offset+cw.n, size, remoteFilename)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &DownloadFileResponse{}
+	dr.RemoteFileId = remoteFileId
+	dr.Content = w
+	dr.DownloadSize = cw.n
+	dr.StorageServer = storeServ
+	return dr, nil
+}
+
+// DownloadReader opens the requested range of remoteFileId as a stream bound to a
+// pooled storage connection. The caller must Close it to release the connection;
+// with DownloadReaderContext, ctx governs the stream until then.
+func (this *FdfsClient) DownloadReader(remoteFileId string, offset int64, downloadSize int64) (io.ReadCloser, error) {
+	return this.DownloadReaderContext(context.Background(), remoteFileId, offset, downloadSize)
+}
+
+func (this *FdfsClient) DownloadReaderContext(ctx context.Context, remoteFileId string, offset int64, downloadSize int64) (io.ReadCloser, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	var rc io.ReadCloser
+	tc := &TrackerClient{this.trackerPool}
+	_, err = this.withFetchFailover(ctx, tc, groupName, remoteFilename,
+		func(store *StorageClient, storeServ *StorageServer) (err error) {
+			rc, err = store.storageDownloadReader(ctx, tc, storeServ, offset, downloadSize, remoteFilename)
+			return err
+		})
+	if err != nil {
+		end()
+		return nil, err
+	}
+	// the call lasts until the stream is closed, as it holds a pooled connection
+	return &callReader{ReadCloser: rc, end: end}, nil
+}
+
+// callReader ends a call when the stream it returned is closed.
+type callReader struct {
+	io.ReadCloser
+	end  func()
+	once sync.Once
+}
+
+func (this *callReader) Close() error {
+	err := this.ReadCloser.Close()
+	this.once.Do(this.end)
+	return err
+}
+
+func (this *FdfsClient) TruncAppenderByFilename(remoteFileId string, truncatedFileSize int64) (*DeleteFileResponse, error) {
+	return this.TruncAppenderByFilenameContext(context.Background(), remoteFileId, truncatedFileSize)
+}
+
+func (this *FdfsClient) TruncAppenderByFilenameContext(ctx context.Context, remoteFileId string, truncatedFileSize int64) (*DeleteFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	tc := &TrackerClient{this.trackerPool}
+
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+
+	return store.storageTruncateFile(ctx, tc, storeServ, remoteFilename, truncatedFileSize)
+}
+func (this *FdfsClient) AppendByFileName(localFileName string, groupName string, remoteFileName string) error {
+	return this.AppendByFileNameContext(context.Background(), localFileName, groupName, remoteFileName)
+}
+
+func (this *FdfsClient) AppendByFileNameContext(ctx context.Context, localFileName string, groupName string, remoteFileName string) error {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	tc := &TrackerClient{this.trackerPool}
+
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFileName)
+	if err != nil {
+		return err
+	}
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return err
+	}
+
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+	return store.storageAppendByfileName(ctx, tc, storeServ, localFileName, groupName, remoteFileName)
+}
+func (this *FdfsClient) ModifyByFileName(localFileName string, offset int64, groupName string, remoteFileName string) error {
+	return this.ModifyByFileNameContext(context.Background(), localFileName, offset, groupName, remoteFileName)
+}
+
+func (this *FdfsClient) ModifyByFileNameContext(ctx context.Context, localFileName string, offset int64, groupName string, remoteFileName string) error {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	tc := &TrackerClient{this.trackerPool}
+
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFileName)
+	if err != nil {
+		return err
+	}
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return err
+	}
+
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+	return store.storageModifyByfileName(ctx, tc, storeServ, localFileName, offset, groupName, remoteFileName)
+}
+
+// AppendByBuffer appends filebuffer to the appender file remoteFileId and
+// returns the new size of the file.
+func (this *FdfsClient) AppendByBuffer(filebuffer []byte, remoteFileId string) (int64, error) {
+	return this.AppendByBufferContext(context.Background(), filebuffer, remoteFileId)
+}
+
+func (this *FdfsClient) AppendByBufferContext(ctx context.Context, filebuffer []byte, remoteFileId string) (int64, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	return this.AppendByReaderContext(ctx, bytes.NewReader(filebuffer), int64(len(filebuffer)), remoteFileId)
+}
+
+// AppendByReader appends exactly size bytes read from r to the appender file
+// remoteFileId and returns the new size of the file.
+func (this *FdfsClient) AppendByReader(r io.Reader, size int64, remoteFileId string) (int64, error) {
+	return this.AppendByReaderContext(context.Background(), r, size, remoteFileId)
+}
+
+func (this *FdfsClient) AppendByReaderContext(ctx context.Context, r io.Reader, size int64, remoteFileId string) (int64, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	if size < 0 {
+		return 0, fmt.Errorf("invalid append size %d", size)
+	}
+	return this.updateAppender(ctx, remoteFileId, func(store *StorageClient, groupName string, remoteFilename string) error {
+		return store.storageAppendByReader(ctx, r, size, groupName, remoteFilename)
+	})
+}
+
+// ModifyByBuffer overwrites the appender file remoteFileId with filebuffer
+// from offset on and returns the new size of the file.
+func (this *FdfsClient) ModifyByBuffer(filebuffer []byte, offset int64, remoteFileId string) (int64, error) {
+	return this.ModifyByBufferContext(context.Background(), filebuffer, offset, remoteFileId)
+}
+
+func (this *FdfsClient) ModifyByBufferContext(ctx context.Context, filebuffer []byte, offset int64, remoteFileId string) (int64, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	return this.ModifyByReaderContext(ctx, bytes.NewReader(filebuffer), int64(len(filebuffer)), offset, remoteFileId)
+}
+
+// ModifyByReader overwrites the appender file remoteFileId with exactly size
+// bytes read from r from offset on and returns the new size of the file.
+func (this *FdfsClient) ModifyByReader(r io.Reader, size int64, offset int64, remoteFileId string) (int64, error) {
+	return this.ModifyByReaderContext(context.Background(), r, size, offset, remoteFileId)
+}
+
+func (this *FdfsClient) ModifyByReaderContext(ctx context.Context, r io.Reader, size int64, offset int64, remoteFileId string) (int64, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	if size < 0 || offset < 0 {
+		return 0, fmt.Errorf("invalid modify size %d or offset %d", size, offset)
+	}
+	return this.updateAppender(ctx, remoteFileId, func(store *StorageClient, groupName string, remoteFilename string) error {
+		return store.storageModifyByReader(ctx, r, size, offset, groupName, remoteFilename)
+	})
+}
+
+// updateAppender runs op on the storage server that accepts updates of
+// remoteFileId and then asks the same server for the new file size.
+func (this *FdfsClient) updateAppender(ctx context.Context, remoteFileId string,
+	op func(store *StorageClient, groupName string, remoteFilename string) error) (int64, error) {
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return 0, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFilename)
+	if err != nil {
+		return 0, err
+	}
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return 0, err
+	}
+
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+	if err = op(store, groupName, remoteFilename); err != nil {
+		return 0, err
+	}
+	info, err := store.storageQueryFileInfo(ctx, groupName, remoteFilename)
+	if err != nil {
+		return 0, err
+	}
+	return info.FileSize, nil
+}
+
+// RegenerateAppenderFilename seals the appender file appenderFileId: it becomes
+// a normal file that can no longer be appended to, under the returned new file id.
+// Requires FastDFS 5.x storage servers.
+func (this *FdfsClient) RegenerateAppenderFilename(appenderFileId string) (*UploadFileResponse, error) {
+	return this.RegenerateAppenderFilenameContext(context.Background(), appenderFileId)
+}
+
+func (this *FdfsClient) RegenerateAppenderFilenameContext(ctx context.Context, appenderFileId string) (*UploadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(appenderFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+	return store.storageRegenerateAppenderFilename(ctx, tc, storeServ, remoteFilename)
+}
+
+// SetMetadata stores metaData on remoteFileId. opFlag is STORAGE_SET_METADATA_FLAG_OVERWRITE
+// to replace all existing items or STORAGE_SET_METADATA_FLAG_MERGE to update them in place.
+func (this *FdfsClient) SetMetadata(remoteFileId string, metaData map[string]string, opFlag byte) error {
+	return this.SetMetadataContext(context.Background(), remoteFileId, metaData, opFlag)
+}
+
+func (this *FdfsClient) SetMetadataContext(ctx context.Context, remoteFileId string, metaData map[string]string, opFlag byte) error {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := tc.trackerQueryStorageUpdate(ctx, groupName, remoteFilename)
+	if err != nil {
+		return err
+	}
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return err
+	}
+
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+	return store.storageSetMetadata(ctx, tc, storeServ, remoteFilename, metaData, opFlag)
+}
+
+func (this *FdfsClient) GetMetadata(remoteFileId string) (*GetMetadataResponse, error) {
+	return this.GetMetadataContext(context.Background(), remoteFileId)
+}
+
+func (this *FdfsClient) GetMetadataContext(ctx context.Context, remoteFileId string) (*GetMetadataResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	tc := &TrackerClient{this.trackerPool}
+	storeServ, err := tc.trackerQueryStorageFetch(ctx, groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &StorageClient{storagePool, this.config.VerifyChecksum}
+	return store.storageGetMetadata(ctx, tc, storeServ, remoteFilename)
+}
+
+// ListGroups returns the statistics of every group known to the tracker.
+func (this *FdfsClient) ListGroups() ([]GroupStat, error) {
+	return this.ListGroupsContext(context.Background())
+}
+
+func (this *FdfsClient) ListGroupsContext(ctx context.Context) ([]GroupStat, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	tc := &TrackerClient{this.trackerPool}
+	return tc.trackerListGroups(ctx)
+}
+
+func (this *FdfsClient) ListGroup(groupName string) (*GroupStat, error) {
+	return this.ListGroupContext(context.Background(), groupName)
+}
+
+func (this *FdfsClient) ListGroupContext(ctx context.Context, groupName string) (*GroupStat, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	tc := &TrackerClient{this.trackerPool}
+	return tc.trackerListGroup(ctx, groupName)
+}
+
+// ListStorages returns the storage servers of groupName, or only the one
+// matching storageId (an id or IP address) when it is not empty. With storage
+// ids configured, an IP address is looked up in them.
+func (this *FdfsClient) ListStorages(groupName string, storageId string) ([]StorageStat, error) {
+	return this.ListStoragesContext(context.Background(), groupName, storageId)
+}
+
+func (this *FdfsClient) ListStoragesContext(ctx context.Context, groupName string, storageId string) ([]StorageStat, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	tc := &TrackerClient{this.trackerPool}
+	return tc.trackerListStorages(ctx, groupName, this.config.StorageIds.resolve(groupName, storageId))
+}
+
+// QueryFetchStorages returns every storage server holding remoteFileId, the
+// one the tracker would pick for a download first.
+func (this *FdfsClient) QueryFetchStorages(remoteFileId string) ([]StorageServer, error) {
+	return this.QueryFetchStoragesContext(context.Background(), remoteFileId)
+}
+
+func (this *FdfsClient) QueryFetchStoragesContext(ctx context.Context, remoteFileId string) ([]StorageServer, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	tc := &TrackerClient{this.trackerPool}
+	return tc.trackerQueryStorageFetchAll(ctx, fileId.GroupName, fileId.Filename())
+}
+
+// QueryStoreStorages returns every storage server of groupName that accepts
+// uploads. An empty groupName lets the tracker choose the group.
+func (this *FdfsClient) QueryStoreStorages(groupName string) ([]StorageServer, error) {
+	return this.QueryStoreStoragesContext(context.Background(), groupName)
+}
+
+func (this *FdfsClient) QueryStoreStoragesContext(ctx context.Context, groupName string) ([]StorageServer, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	tc := &TrackerClient{this.trackerPool}
+	return tc.trackerQueryStorageStorAll(ctx, groupName)
+}
+
+// DeleteStorageResult is the outcome of DeleteStorage on one tracker.
+type DeleteStorageResult struct {
+	TrackerAddr string
+	Err         error
+}
+
+// DeleteStorage removes storage server storageId (an id or IP address) from
+// groupName on every configured tracker, as fdfs_monitor does, and returns the
+// result of each tracker. A server some tracker still reports as ACTIVE is only
+// deleted when force is set. The error is nil when at least one tracker deleted
+// the server and the others did not know it.
+func (this *FdfsClient) DeleteStorage(groupName string, storageId string, force bool) ([]DeleteStorageResult, error) {
+	return this.DeleteStorageContext(context.Background(), groupName, storageId, force)
+}
+
+func (this *FdfsClient) DeleteStorageContext(ctx context.Context, groupName string, storageId string, force bool) ([]DeleteStorageResult, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	storageId = this.config.StorageIds.resolve(groupName, storageId)
+	trackers := make([]*TrackerClient, len(this.tracker.HostList))
+	for i, host := range this.tracker.HostList {
+		config := this.config
+		config.MinConns, config.MaxConns = 0, 1
+		pool, err := config.newPool([]string{host}, []int{this.tracker.Ports[i]})
+		if err != nil {
+			return nil, err
+		}
+		defer pool.Close()
+		trackers[i] = &TrackerClient{pool}
+	}
+
+	if !force {
+		for i, tc := range trackers {
+			storages, err := tc.trackerListStorages(ctx, groupName, storageId)
+			if errno, ok := err.(Errno); ok && errno.status == 2 {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			for _, storage := range storages {
+				if storage.Status == FDFS_STORAGE_STATUS_ACTIVE {
+					return nil, fmt.Errorf("storage server %s of group %s is ACTIVE on tracker %s",
+						storageId, groupName, this.trackerAddr(i))
+				}
+			}
+		}
+	}
+
+	var (
+		results  = make([]DeleteStorageResult, len(trackers))
+		deleted  int
+		firstErr error
+	)
+	for i, tc := range trackers {
+		err := tc.trackerDeleteStorage(ctx, groupName, storageId)
+		results[i] = DeleteStorageResult{TrackerAddr: this.trackerAddr(i), Err: err}
+		if err == nil {
+			deleted++
+		} else if errno, ok := err.(Errno); !ok || errno.status != 2 {
+			this.config.Logger.Warnf("delete storage %s from tracker %s error :%s", storageId, results[i].TrackerAddr, err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return results, firstErr
+	}
+	if deleted == 0 {
+		return results, Errno{2}
+	}
+	return results, nil
+}
+
+func (this *FdfsClient) trackerAddr(i int) string {
+	return net.JoinHostPort(this.tracker.HostList[i], strconv.Itoa(this.tracker.Ports[i]))
+}
+
+// getStoragePool returns the client's pool for the storage server, opening it
+// on first use.
+func (this *FdfsClient) getStoragePool(ipAddr string, port int) (*ConnectionPool, error) {
+	key := net.JoinHostPort(ipAddr, strconv.Itoa(port))
+	this.mu.Lock()
+	pool, ok := this.storagePools[key]
+	closed := this.storagePools == nil
+	this.mu.Unlock()
+	if ok {
+		return pool, nil
+	} else if closed {
+		return nil, ErrClosed
+	}
+
+	// dial without holding the lock
+	pool, err := this.config.newPool([]string{ipAddr}, []int{port})
+	if err != nil {
+		this.config.Logger.Error("failed to open connection pool" + err.Error())
+		return nil, err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.storagePools == nil {
+		pool.Close()
+		return nil, ErrClosed
+	}
+	if existing, ok := this.storagePools[key]; ok {
+		pool.Close()
+		return existing, nil
+	}
+	this.storagePools[key] = pool
+	return pool, nil
 }
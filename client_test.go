@@ -1,11 +1,18 @@
 package fdfs_client
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
-	//"strings"
+	"strings"
 	"testing"
 	"time"
 )
@@ -272,55 +279,55 @@ func TestUploadAppenderByFilename(t *testing.T) {
 
 	t.Log(uploadResponse.GroupName)
 	t.Log(uploadResponse.RemoteFileId)
-	parts, err := splitRemoteFileId(uploadResponse.RemoteFileId)
+	fileId, err := ParseFileID(uploadResponse.RemoteFileId)
 	if err != nil {
 		t.Error(err)
 	}
-	groupName := parts[0]
-	remoteFileName := parts[1]
+	groupName := fileId.GroupName
+	remoteFileName := fileId.Filename()
 
-	fileInfo, err := fdfsClient.getFileInfo(uploadResponse.RemoteFileId)
+	fileInfo, err := fdfsClient.GetFileInfo(uploadResponse.RemoteFileId)
 	if err != nil {
 		t.Error("get file info error" + err.Error())
 	}
 
-	fileInfo.Print()
-	fileSize := fileInfo.fileSize
+	t.Log(fileInfo)
+	fileSize := fileInfo.FileSize
 	//group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE4174280
 	if deleteResponse, err = fdfsClient.TruncAppenderByFilename(uploadResponse.RemoteFileId, fileSize/2); err != nil {
 		t.Errorf("Truncate Appender File error %s", err.Error())
 	}
 	t.Log(deleteResponse.groupName)
 	t.Log(deleteResponse.remoteFilename)
-	fileInfo, err = fdfsClient.getFileInfo(uploadResponse.RemoteFileId)
+	fileInfo, err = fdfsClient.GetFileInfo(uploadResponse.RemoteFileId)
 	if err != nil {
 		t.Error("get file info error" + err.Error())
 	}
 
-	fileInfo.Print()
-	if fileInfo.fileSize != fileSize/2 {
-		t.Errorf("filesize:%d != %d", fileInfo.fileSize, fileSize/2)
+	t.Log(fileInfo)
+	if fileInfo.FileSize != fileSize/2 {
+		t.Errorf("filesize:%d != %d", fileInfo.FileSize, fileSize/2)
 	}
 
 	if err = fdfsClient.AppendByFileName("x1", groupName, remoteFileName); err != nil {
 		t.Error("can't append file")
 	}
-	fileInfo, err = fdfsClient.getFileInfo(uploadResponse.RemoteFileId)
+	fileInfo, err = fdfsClient.GetFileInfo(uploadResponse.RemoteFileId)
 	if err != nil {
 		t.Error("get file info error" + err.Error())
 	}
-	fileInfo.Print()
+	t.Log(fileInfo)
 
-	offset := fileInfo.fileSize
+	offset := fileInfo.FileSize
 	if err = fdfsClient.ModifyByFileName("x1", offset, groupName, remoteFileName); err != nil {
 		t.Error("can't modify file")
 	}
 
-	fileInfo, err = fdfsClient.getFileInfo(uploadResponse.RemoteFileId)
+	fileInfo, err = fdfsClient.GetFileInfo(uploadResponse.RemoteFileId)
 	if err != nil {
 		t.Error("get file info error" + err.Error())
 	}
-	fileInfo.Print()
+	t.Log(fileInfo)
 }
 func TestDeleteFile(t *testing.T) {
 	fdfsClient, err := NewFdfsClient("client.conf")
@@ -472,12 +479,978 @@ func TestGetFileInfo(t *testing.T) {
 		return
 	}
 
-	fileInfo, err := fdfsClient.getFileInfo("group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE4174280")
+	fileInfo, err := fdfsClient.GetFileInfo("group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE4174280")
 	if err != nil {
 		t.Error("get file info error" + err.Error())
 	}
-	logger.Info("createtime:" + time.Unix(int64(fileInfo.createTimeStamp), 0).String())
-	logger.Infof("crc:%d", fileInfo.crc32)
-	logger.Info("source ip:" + fileInfo.sourceIpAddress)
-	logger.Infof("filesize:%d", fileInfo.fileSize)
+	t.Log(fileInfo)
+}
+
+func TestSetMetadata(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	uploadResponse, err = fdfsClient.UploadByFilename("client.conf")
+	if err != nil {
+		t.Errorf("UploadByfilename error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	metaData := map[string]string{"content-type": "text/plain", "owner": "test"}
+	if err = fdfsClient.SetMetadata(uploadResponse.RemoteFileId, metaData, STORAGE_SET_METADATA_FLAG_OVERWRITE); err != nil {
+		t.Errorf("SetMetadata error %s", err.Error())
+	}
+	if err = fdfsClient.SetMetadata(uploadResponse.RemoteFileId, map[string]string{"owner": "merged"}, STORAGE_SET_METADATA_FLAG_MERGE); err != nil {
+		t.Errorf("SetMetadata error %s", err.Error())
+	}
+
+	metaResponse, err := fdfsClient.GetMetadata(uploadResponse.RemoteFileId)
+	if err != nil {
+		t.Errorf("GetMetadata error %s", err.Error())
+		return
+	}
+	if metaResponse.MetaData["content-type"] != "text/plain" || metaResponse.MetaData["owner"] != "merged" {
+		t.Errorf("unexpected metadata %v", metaResponse.MetaData)
+	}
+}
+
+func TestPackMetadata(t *testing.T) {
+	metaData := map[string]string{"width": "1024", "height": "768"}
+	buf, err := packMetadata(metaData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "height\x02768\x01width\x021024" {
+		t.Errorf("unexpected packed metadata %q", buf)
+	}
+	unpacked, err := unpackMetadata(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unpacked) != 2 || unpacked["width"] != "1024" || unpacked["height"] != "768" {
+		t.Errorf("unexpected unpacked metadata %v", unpacked)
+	}
+
+	longName := make([]byte, FDFS_MAX_META_NAME_LEN+1)
+	for i := range longName {
+		longName[i] = 'n'
+	}
+	if _, err = packMetadata(map[string]string{string(longName): "v"}); err == nil {
+		t.Error("expected error for metadata name over FDFS_MAX_META_NAME_LEN")
+	}
+	longValue := make([]byte, FDFS_MAX_META_VALUE_LEN+1)
+	if _, err = packMetadata(map[string]string{"name": string(longValue)}); err == nil {
+		t.Error("expected error for metadata value over FDFS_MAX_META_VALUE_LEN")
+	}
+}
+
+func TestUploadByBufferWithMetadata(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	metaData := map[string]string{"content-type": "text/plain", "filename": "testfile"}
+	uploadResponse, err = fdfsClient.UploadByBufferWithMetadata([]byte("hello fastdfs"), "txt", metaData, true)
+	if err != nil {
+		t.Errorf("UploadByBufferWithMetadata error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	metaResponse, err := fdfsClient.GetMetadata(uploadResponse.RemoteFileId)
+	if err != nil {
+		t.Errorf("GetMetadata error %s", err.Error())
+		return
+	}
+	if metaResponse.MetaData["filename"] != "testfile" {
+		t.Errorf("unexpected metadata %v", metaResponse.MetaData)
+	}
+}
+
+func TestUploadByReader(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	file, err := os.Open("testfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadResponse, err = fdfsClient.UploadByReader(file, fileInfo.Size(), "txt")
+	if err != nil {
+		t.Errorf("UploadByReader error %s", err.Error())
+		return
+	}
+	t.Log(uploadResponse.GroupName)
+	t.Log(uploadResponse.RemoteFileId)
+	fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+}
+
+func TestDownloadToWriter(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	content := []byte("stream me to a writer")
+	uploadResponse, err = fdfsClient.UploadByBuffer(content, "txt")
+	if err != nil {
+		t.Errorf("UploadByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	var buffer bytes.Buffer
+	downloadResponse, err := fdfsClient.DownloadToWriter(uploadResponse.RemoteFileId, &buffer, 0, 0)
+	if err != nil {
+		t.Errorf("DownloadToWriter error %s", err.Error())
+		return
+	}
+	if downloadResponse.DownloadSize != int64(len(content)) || !bytes.Equal(buffer.Bytes(), content) {
+		t.Errorf("DownloadToWriter got %q", buffer.Bytes())
+	}
+
+	reader, err := fdfsClient.DownloadReader(uploadResponse.RemoteFileId, 7, 2)
+	if err != nil {
+		t.Errorf("DownloadReader error %s", err.Error())
+		return
+	}
+	defer reader.Close()
+	part, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Errorf("DownloadReader read error %s", err.Error())
+	}
+	if string(part) != "me" {
+		t.Errorf("DownloadReader got %q", part)
+	}
+}
+
+func TestUploadByBufferContextTimeout(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	if _, err = fdfsClient.UploadByBufferContext(ctx, []byte("too late"), "txt"); err != context.DeadlineExceeded {
+		t.Errorf("UploadByBufferContext error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestListStorages(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	groups, err := fdfsClient.ListGroups()
+	if err != nil {
+		t.Errorf("ListGroups error %s", err.Error())
+		return
+	}
+	for _, group := range groups {
+		t.Logf("group %s: free %d/%d MB, %d/%d active", group.GroupName,
+			group.FreeMB, group.TotalMB, group.ActiveCount, group.StorageCount)
+		storages, err := fdfsClient.ListStorages(group.GroupName, "")
+		if err != nil {
+			t.Errorf("ListStorages error %s", err.Error())
+			return
+		}
+		if len(storages) != group.StorageCount {
+			t.Errorf("ListStorages returned %d storages, want %d", len(storages), group.StorageCount)
+		}
+		for _, storage := range storages {
+			t.Logf("  %s %s v%s uploads %d heartbeat %s", storage.IpAddr, storage.StatusName(),
+				storage.Version, storage.SuccessUploadCount, storage.LastHeartBeatTime)
+		}
+	}
+}
+
+func TestUnmarshalStorageStats(t *testing.T) {
+	if size := binary.Size(groupStatBuff{}); size != 105 {
+		t.Errorf("group stat size %d, want 105", size)
+	}
+	if size := binary.Size(storageStatBuff{}); size != 612 {
+		t.Errorf("storage stat size %d, want 612", size)
+	}
+
+	buff := storageStatBuff{Status: FDFS_STORAGE_STATUS_ACTIVE, StoragePort: 23000, LastHeartBeatTime: 1500000000}
+	copy(buff.IpAddr[:], "192.168.0.1")
+	buff.Counters.SuccessUploadCount = 42
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.BigEndian, &buff)
+	binary.Write(data, binary.BigEndian, &buff)
+
+	stats, err := unmarshalStorageStats(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("got %d storages, want 2", len(stats))
+	}
+	stat := stats[1]
+	if stat.StatusName() != "ACTIVE" || stat.IpAddr != "192.168.0.1" || stat.StoragePort != 23000 ||
+		stat.SuccessUploadCount != 42 || stat.LastHeartBeatTime.Unix() != 1500000000 {
+		t.Errorf("unexpected storage stat %+v", stat)
+	}
+	if _, err = unmarshalStorageStats(data.Bytes()[1:]); err == nil {
+		t.Error("truncated storage list accepted")
+	}
+}
+
+func TestStorageIdMaxSize(t *testing.T) {
+	pool, err := newConnectionPool([]string{"127.0.0.1"}, []int{1}, 0, 1, time.Second, time.Second, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	tc := &TrackerClient{pool}
+
+	longId := strings.Repeat("1", FDFS_STORAGE_ID_MAX_SIZE)
+	if _, err = tc.trackerListStorages(context.Background(), "group1", longId); err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("list storage id of %d bytes returned %v, want it refused", len(longId), err)
+	}
+	if err = tc.trackerDeleteStorage(context.Background(), "group1", longId); err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("delete storage id of %d bytes returned %v, want it refused", len(longId), err)
+	}
+	// one byte less fits, and fails only at the unreachable tracker
+	if _, err = tc.trackerListStorages(context.Background(), "group1", longId[1:]); err == nil || strings.Contains(err.Error(), "longer than") {
+		t.Errorf("list storage id of %d bytes returned %v, want it sent", len(longId)-1, err)
+	}
+}
+
+func TestDeleteStorageRefusesActive(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	groups, err := fdfsClient.ListGroups()
+	if err != nil || len(groups) == 0 {
+		t.Errorf("ListGroups error %v", err)
+		return
+	}
+	storages, err := fdfsClient.ListStorages(groups[0].GroupName, "")
+	if err != nil {
+		t.Errorf("ListStorages error %s", err.Error())
+		return
+	}
+	for _, storage := range storages {
+		if storage.Status != FDFS_STORAGE_STATUS_ACTIVE {
+			continue
+		}
+		if _, err = fdfsClient.DeleteStorage(groups[0].GroupName, storage.IpAddr, false); err == nil {
+			t.Errorf("DeleteStorage deleted active storage %s", storage.IpAddr)
+		}
+		return
+	}
+}
+
+func TestQueryFetchStorages(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	stores, err := fdfsClient.QueryStoreStorages("")
+	if err != nil {
+		t.Errorf("QueryStoreStorages error %s", err.Error())
+		return
+	}
+	for _, store := range stores {
+		t.Logf("store %s/%s path %d", store.GroupName(), store.String(), store.StorePathIndex())
+	}
+
+	uploadResponse, err := fdfsClient.UploadByBuffer([]byte("fetch all"), "txt")
+	if err != nil {
+		t.Errorf("UploadByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	storages, err := fdfsClient.QueryFetchStorages(uploadResponse.RemoteFileId)
+	if err != nil {
+		t.Errorf("QueryFetchStorages error %s", err.Error())
+		return
+	}
+	if len(storages) == 0 || storages[0].GroupName() != uploadResponse.GroupName {
+		t.Errorf("QueryFetchStorages returned %v", storages)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	want := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for attempt, d := range want {
+		if got := policy.backoff(attempt); got != d {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, d)
+		}
+	}
+	if isRetryable(context.Background(), Errno{22}) {
+		t.Error("EINVAL is retryable")
+	}
+	if !isRetryable(context.Background(), Errno{2}) {
+		t.Error("ENOENT is not retryable")
+	}
+	if !isRetryable(context.Background(), io.ErrUnexpectedEOF) {
+		t.Error("a broken connection is not retryable")
+	}
+	if isRetryable(context.Background(), &os.PathError{Op: "open", Path: "/tmp/x", Err: os.ErrPermission}) {
+		t.Error("a local file error is retryable")
+	}
+	if isRetryable(context.Background(), ErrClosed) {
+		t.Error("ErrClosed is retryable")
+	}
+}
+
+func TestDownloadToBufferStorageServer(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	uploadResponse, err := fdfsClient.UploadByBuffer([]byte("failover"), "txt")
+	if err != nil {
+		t.Errorf("UploadByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	downloadResponse, err := fdfsClient.DownloadToBuffer(uploadResponse.RemoteFileId, 0, 0)
+	if err != nil {
+		t.Errorf("DownloadToBuffer error %s", err.Error())
+		return
+	}
+	if downloadResponse.StorageServer == nil {
+		t.Error("DownloadToBuffer did not report the serving storage server")
+		return
+	}
+	t.Logf("served by %s", downloadResponse.StorageServer.String())
+}
+
+func TestReplayableReader(t *testing.T) {
+	seekable := newReplayableReader(bytes.NewReader([]byte("0123456789")))
+	ioutil.ReadAll(io.LimitReader(seekable.reader, 4))
+	if !seekable.canReplay() {
+		t.Error("seekable reader cannot replay")
+	}
+	if err := seekable.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(seekable.reader); string(data) != "0123456789" {
+		t.Errorf("replayed %q", data)
+	}
+
+	stream := newReplayableReader(struct{ io.Reader }{bytes.NewReader([]byte("0123456789"))})
+	if !stream.canReplay() {
+		t.Error("untouched stream cannot replay")
+	}
+	ioutil.ReadAll(io.LimitReader(stream.reader, 4))
+	if stream.canReplay() {
+		t.Error("partially read stream can replay")
+	}
+}
+
+func TestCreateLink(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	content := []byte("linked content")
+	uploadResponse, err := fdfsClient.UploadByBuffer(content, "txt")
+	if err != nil {
+		t.Errorf("UploadByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	linkResponse, err := fdfsClient.CreateLink(uploadResponse.RemoteFileId, "txt", "")
+	if err != nil {
+		t.Errorf("CreateLink error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(linkResponse.RemoteFileId)
+	if linkResponse.RemoteFileId == uploadResponse.RemoteFileId {
+		t.Error("CreateLink returned the source file id")
+	}
+
+	downloadResponse, err := fdfsClient.DownloadToBuffer(linkResponse.RemoteFileId, 0, 0)
+	if err != nil {
+		t.Errorf("DownloadToBuffer error %s", err.Error())
+		return
+	}
+	if !bytes.Equal(downloadResponse.Content.([]byte), content) {
+		t.Errorf("link content %q, want %q", downloadResponse.Content, content)
+	}
+}
+
+func TestAppendAndModifyByBuffer(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	uploadResponse, err := fdfsClient.UploadAppenderByBuffer([]byte("line1\n"), "log")
+	if err != nil {
+		t.Errorf("UploadAppenderByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	size, err := fdfsClient.AppendByBuffer([]byte("line2\n"), uploadResponse.RemoteFileId)
+	if err != nil {
+		t.Errorf("AppendByBuffer error %s", err.Error())
+		return
+	}
+	if size != 12 {
+		t.Errorf("size after append %d, want 12", size)
+	}
+
+	size, err = fdfsClient.ModifyByReader(bytes.NewReader([]byte("LINE")), 4, 6, uploadResponse.RemoteFileId)
+	if err != nil {
+		t.Errorf("ModifyByReader error %s", err.Error())
+		return
+	}
+	if size != 12 {
+		t.Errorf("size after modify %d, want 12", size)
+	}
+
+	downloadResponse, err := fdfsClient.DownloadToBuffer(uploadResponse.RemoteFileId, 0, 0)
+	if err != nil {
+		t.Errorf("DownloadToBuffer error %s", err.Error())
+		return
+	}
+	if content := string(downloadResponse.Content.([]byte)); content != "line1\nLINE2\n" {
+		t.Errorf("content %q", content)
+	}
+}
+
+func TestRegenerateAppenderFilename(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	uploadResponse, err := fdfsClient.UploadAppenderByBuffer([]byte("part1"), "bin")
+	if err != nil {
+		t.Errorf("UploadAppenderByBuffer error %s", err.Error())
+		return
+	}
+	if _, err = fdfsClient.AppendByBuffer([]byte("part2"), uploadResponse.RemoteFileId); err != nil {
+		t.Errorf("AppendByBuffer error %s", err.Error())
+		fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+		return
+	}
+
+	sealed, err := fdfsClient.RegenerateAppenderFilename(uploadResponse.RemoteFileId)
+	if err != nil {
+		t.Errorf("RegenerateAppenderFilename error %s", err.Error())
+		fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+		return
+	}
+	defer fdfsClient.DeleteFile(sealed.RemoteFileId)
+	if sealed.RemoteFileId == uploadResponse.RemoteFileId {
+		t.Error("RegenerateAppenderFilename kept the appender file id")
+	}
+	if _, err = fdfsClient.AppendByBuffer([]byte("part3"), sealed.RemoteFileId); err == nil {
+		t.Error("appended to a sealed file")
+	}
+}
+
+func TestChunkedUploader(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	localFile, err := ioutil.TempFile("", "chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localFile.Name())
+	localFile.Write(content)
+	localFile.Close()
+
+	var calls int
+	uploader := NewChunkedUploader(fdfsClient, 4096)
+	uploader.Progress = func(uploaded int64, total int64) {
+		calls++
+		if total != int64(len(content)) {
+			t.Errorf("progress total %d, want %d", total, len(content))
+		}
+	}
+	uploadResponse, err := uploader.Upload(localFile.Name(), "bin")
+	if err != nil {
+		t.Errorf("ChunkedUploader.Upload error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+	if calls != 3 {
+		t.Errorf("progress called %d times, want 3", calls)
+	}
+	if _, err = os.Stat(localFile.Name() + ".fdfs_upload"); !os.IsNotExist(err) {
+		t.Error("checkpoint left behind")
+	}
+
+	downloadResponse, err := fdfsClient.DownloadToBuffer(uploadResponse.RemoteFileId, 0, 0)
+	if err != nil {
+		t.Errorf("DownloadToBuffer error %s", err.Error())
+		return
+	}
+	if !bytes.Equal(downloadResponse.Content.([]byte), content) {
+		t.Error("chunked upload content mismatch")
+	}
+}
+
+func TestUploadCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/upload.json"
+
+	if cp, err := loadUploadCheckpoint(path); cp != nil || err != nil {
+		t.Errorf("missing checkpoint loaded as %v, %v", cp, err)
+	}
+	saved := &uploadCheckpoint{LocalFilename: "big.bin", FileSize: 10, ModTime: 1, ChunkSize: 4,
+		RemoteFileId: "group1/M00/00/00/x.bin", Uploaded: 8}
+	if err = saved.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadUploadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded != *saved {
+		t.Errorf("loaded %+v, want %+v", loaded, saved)
+	}
+	changed := *saved
+	changed.ModTime = 2
+	if loaded.matches(&changed) {
+		t.Error("checkpoint matches a modified file")
+	}
+}
+
+func TestChunkedUploaderRegenerated(t *testing.T) {
+	fdfsClient, err := NewFdfsClientByTracker(&Tracker{[]string{"127.0.0.1"}, []int{22122}})
+	if err != nil {
+		t.Errorf("NewFdfsClientByTracker error %s", err.Error())
+		return
+	}
+	defer fdfsClient.Close()
+
+	localFile, err := ioutil.TempFile("", "chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localFile.Name())
+	localFile.Write([]byte("0123456789"))
+	localFile.Close()
+	stat, _ := os.Stat(localFile.Name())
+
+	// a crash after regenerating left the new file id in the checkpoint
+	checkpointPath := localFile.Name() + ".fdfs_upload"
+	cp := &uploadCheckpoint{LocalFilename: localFile.Name(), FileSize: 10, ModTime: stat.ModTime().UnixNano(),
+		ChunkSize: 4, RemoteFileId: "group1/M00/00/00/wKj_glc-fQiEISCUAAAAAChSBpE.bin", Uploaded: 10,
+		Regenerating: true, RegeneratedFileId: "group1/M00/00/00/wKj_glc-fQiEISCUAAAAAChSBpE.txt"}
+	if err = cp.save(checkpointPath); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(checkpointPath)
+
+	uploader := NewChunkedUploader(fdfsClient, 4)
+	uploader.Regenerate = true
+	uploadResponse, err := uploader.Upload(localFile.Name(), "bin")
+	if err != nil {
+		t.Errorf("ChunkedUploader.Upload error %s", err.Error())
+		return
+	}
+	if uploadResponse.RemoteFileId != cp.RegeneratedFileId || uploadResponse.GroupName != "group1" {
+		t.Errorf("resumed upload returned %+v, want %s", uploadResponse, cp.RegeneratedFileId)
+	}
+	if _, err = os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Error("checkpoint left behind")
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	ranges := splitRange(10, 3)
+	want := []byteRange{{0, 4}, {4, 3}, {7, 3}}
+	if len(ranges) != len(want) {
+		t.Fatalf("got %d ranges, want %d", len(ranges), len(want))
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("range %d is %+v, want %+v", i, ranges[i], want[i])
+		}
+	}
+	if ranges = splitRange(2, 5); len(ranges) != 2 {
+		t.Errorf("2 bytes split into %d ranges", len(ranges))
+	}
+	if ranges = splitRange(0, 5); len(ranges) != 0 {
+		t.Errorf("empty file split into %d ranges", len(ranges))
+	}
+}
+
+func TestParallelDownload(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	content := bytes.Repeat([]byte("parallel"), 10000)
+	uploadResponse, err := fdfsClient.UploadByBuffer(content, "bin")
+	if err != nil {
+		t.Errorf("UploadByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	localPath := os.TempDir() + "/parallel_download.bin"
+	defer os.Remove(localPath)
+	if _, err = fdfsClient.ParallelDownload(uploadResponse.RemoteFileId, localPath, 7, 3); err != nil {
+		t.Errorf("ParallelDownload error %s", err.Error())
+		return
+	}
+	data, err := ioutil.ReadFile(localPath)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("downloaded content mismatch, error %v", err)
+	}
+}
+
+func TestDownloadToFileResumable(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf")
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	content := bytes.Repeat([]byte("resume"), 1000)
+	uploadResponse, err := fdfsClient.UploadByBuffer(content, "bin")
+	if err != nil {
+		t.Errorf("UploadByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	// pretend an earlier download stopped halfway
+	localFilename := os.TempDir() + "/resumable_download.bin"
+	defer os.Remove(localFilename)
+	if err = ioutil.WriteFile(localFilename+".part", content[:len(content)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fdfsClient.DownloadToFileResumable(localFilename, uploadResponse.RemoteFileId); err != nil {
+		t.Errorf("DownloadToFileResumable error %s", err.Error())
+		return
+	}
+	data, err := ioutil.ReadFile(localFilename)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("downloaded content mismatch, error %v", err)
+	}
+	if _, err = os.Stat(localFilename + ".part"); !os.IsNotExist(err) {
+		t.Error(".part file left behind")
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	fdfsClient, err := NewFdfsClient("client.conf", WithVerifyChecksum(true))
+	if err != nil {
+		t.Errorf("New FdfsClient error %s", err.Error())
+		return
+	}
+
+	content := []byte("checksum verified content")
+	uploadResponse, err := fdfsClient.UploadByBuffer(content, "txt")
+	if err != nil {
+		t.Errorf("UploadByBuffer error %s", err.Error())
+		return
+	}
+	defer fdfsClient.DeleteFile(uploadResponse.RemoteFileId)
+
+	downloadResponse, err := fdfsClient.DownloadToBuffer(uploadResponse.RemoteFileId, 0, 0)
+	if err != nil {
+		t.Errorf("DownloadToBuffer error %s", err.Error())
+		return
+	}
+	if !bytes.Equal(downloadResponse.Content.([]byte), content) {
+		t.Error("downloaded content differs")
+	}
+}
+
+func TestDownloadReaderChecksumMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		server.Write([]byte("corrupted"))
+		server.Close()
+	}()
+	r := &downloadReader{conn: client, remaining: 9, remoteFileId: "group1/M00/00/00/test",
+		checksum: crc32.NewIEEE(), expected: crc32.ChecksumIEEE([]byte("corrected"))}
+	_, err := ioutil.ReadAll(r)
+	if _, ok := err.(*ErrChecksumMismatch); !ok {
+		t.Errorf("read corrupted download, got error %v, want *ErrChecksumMismatch", err)
+	}
+	if isRetryable(context.Background(), err) {
+		t.Error("checksum mismatch is retryable")
+	}
+}
+
+func TestChecksumSkipsSlaveFile(t *testing.T) {
+	name := make([]byte, 20)
+	binary.BigEndian.PutUint64(name[8:16], 42)
+	binary.BigEndian.PutUint32(name[16:20], 0xCAFEBABE)
+	master := "M00/00/00/" + coder.EncodeToString(name)[:FDFS_FILENAME_BASE64_LENGTH]
+
+	storageClient := &StorageClient{verifyChecksum: true}
+	if checksum, expected := storageClient.downloadChecksum(0, 0, master+".jpg"); checksum == nil || expected != 0xCAFEBABE {
+		t.Errorf("master file not checked")
+	}
+	// a slave file id carries the CRC32 of its master
+	if checksum, _ := storageClient.downloadChecksum(0, 0, master+"_150x150.jpg"); checksum != nil {
+		t.Errorf("slave file checked against the CRC32 of its master")
+	}
+}
+
+func TestVerifyLocalFileSkipsSlaveFile(t *testing.T) {
+	name := make([]byte, 20)
+	binary.BigEndian.PutUint64(name[8:16], 42)
+	binary.BigEndian.PutUint32(name[16:20], 0xCAFEBABE)
+	master := "group1/M00/00/00/" + coder.EncodeToString(name)[:FDFS_FILENAME_BASE64_LENGTH]
+
+	file, err := ioutil.TempFile("", "fdfs_download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	content := []byte("slave content")
+	file.Write(content)
+
+	// the storage server reports the master's CRC32 for a slave file
+	info := &FileInfo{FileSize: int64(len(content)), Crc32: 0xCAFEBABE}
+	slaveId, _ := ParseFileID(master + "_150x150.jpg")
+	if err = verifyLocalFile(file, info, slaveId.hasChecksum()); err != nil {
+		t.Errorf("verify slave file error %s", err.Error())
+	}
+	masterId, _ := ParseFileID(master + ".jpg")
+	if err = verifyLocalFile(file, info, masterId.hasChecksum()); err == nil {
+		t.Error("master file with a wrong CRC32 verified")
+	}
+	info.FileSize++
+	if err = verifyLocalFile(file, info, slaveId.hasChecksum()); err == nil {
+		t.Error("slave file with a wrong size verified")
+	}
+}
+
+func TestParseRemoteFilename(t *testing.T) {
+	info, err := parseRemoteFilename("M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE.txt")
+	if err != nil {
+		t.Errorf("parseRemoteFilename error %s", err.Error())
+		return
+	}
+	if info.SourceIpAddr != "192.168.255.130" || info.SourceStorageId != "" {
+		t.Errorf("source %q/%q, want 192.168.255.130", info.SourceIpAddr, info.SourceStorageId)
+	}
+	if !info.IsAppender || info.IsTrunk || info.IsSlave {
+		t.Errorf("appender file decoded as %s", info)
+	}
+
+	// a file id carrying a storage id, with random bits above the size
+	name := make([]byte, 20)
+	binary.LittleEndian.PutUint32(name[0:4], 100001)
+	binary.BigEndian.PutUint64(name[8:16], 1<<63|0x12345<<32|42)
+	encoded := coder.EncodeToString(name)[:FDFS_FILENAME_BASE64_LENGTH]
+	if info, err = parseRemoteFilename("M00/00/00/" + encoded + ".txt"); err != nil {
+		t.Errorf("parseRemoteFilename error %s", err.Error())
+		return
+	}
+	if info.SourceStorageId != "100001" || info.IsAppender || info.FileSize != 42 {
+		t.Errorf("normal file decoded as %s", info)
+	}
+
+	// a file of 4GB or more keeps its full size
+	binary.BigEndian.PutUint64(name[8:16], 5<<30)
+	encoded = coder.EncodeToString(name)[:FDFS_FILENAME_BASE64_LENGTH]
+	if info, err = parseRemoteFilename("M00/00/00/" + encoded + ".iso"); err != nil {
+		t.Errorf("parseRemoteFilename error %s", err.Error())
+		return
+	}
+	if info.FileSize != 5<<30 {
+		t.Errorf("file size %d, want %d", info.FileSize, int64(5<<30))
+	}
+}
+
+func TestParseFileID(t *testing.T) {
+	for _, s := range []string{
+		"group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE",
+		"group1/M01/0A/FF/wKj_glc-fQiEISCUAAAAAChSBpE.tar",
+		"group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE_150x150.jpg",
+	} {
+		fileId, err := ParseFileID(s)
+		if err != nil {
+			t.Errorf("ParseFileID(%q) error %s", s, err.Error())
+			continue
+		}
+		if fileId.String() != s {
+			t.Errorf("ParseFileID(%q).String() = %q", s, fileId.String())
+		}
+	}
+
+	fileId, _ := ParseFileID("group1/M01/0A/FF/wKj_glc-fQiEISCUAAAAAChSBpE_150x150.jpg")
+	if fileId.GroupName != "group1" || fileId.StorePathIndex != 1 || fileId.Dir != "0A/FF" ||
+		fileId.Prefix != "_150x150" || fileId.Ext != "jpg" || !fileId.IsSlave() {
+		t.Errorf("parsed slave file id as %+v", fileId)
+	}
+
+	for _, s := range []string{
+		"M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE.txt",
+		"/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE.txt",
+		"group1/X00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE.txt",
+		"group1/M00/00/03/wKj_glc-fQiEISCU.txt",
+		"group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE.toolong",
+		"group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE_prefix_too_long_x.txt",
+	} {
+		if _, err := ParseFileID(s); err == nil {
+			t.Errorf("ParseFileID(%q) accepted an invalid file id", s)
+		}
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	tracker := &Tracker{[]string{"127.0.0.1"}, []int{22122}}
+	first, err := NewFdfsClientByTracker(tracker, WithMaxConns(7), WithTimeouts(time.Second, 2*time.Second))
+	if err != nil {
+		t.Errorf("NewFdfsClientByTracker error %s", err.Error())
+		return
+	}
+	second, err := NewFdfsClientByTracker(tracker)
+	if err != nil {
+		t.Errorf("NewFdfsClientByTracker error %s", err.Error())
+		return
+	}
+	if first.trackerPool.maxConns != 7 || first.trackerPool.connectTimeout != time.Second ||
+		first.trackerPool.networkTimeout != 2*time.Second {
+		t.Errorf("options not applied to the tracker pool: %+v", first.config)
+	}
+	if second.trackerPool.maxConns != DEFAULT_MAX_CONNS || second.config.ConnectTimeout != DEFAULT_CONNECT_TIMEOUT {
+		t.Errorf("options of one client leaked into another: %+v", second.config)
+	}
+
+	if _, err = NewFdfsClientByTracker(tracker, WithMinConns(3), WithMaxConns(2)); err == nil {
+		t.Error("NewFdfsClientByTracker accepted min_conn > max_conn")
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	fdfsClient, err := NewFdfsClientByTracker(&Tracker{[]string{"127.0.0.1"}, []int{22122}})
+	if err != nil {
+		t.Errorf("NewFdfsClientByTracker error %s", err.Error())
+		return
+	}
+	_, end, err := fdfsClient.begin(context.Background())
+	if err != nil {
+		t.Errorf("begin error %s", err.Error())
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		fdfsClient.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Error("Close returned while a call was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	end()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Close did not return after the call finished")
+	}
+
+	if _, err = fdfsClient.DownloadToBuffer("group1/M00/00/00/wKj_glc-fQiEISCUAAAAAChSBpE.txt", 0, 0); err != ErrClosed {
+		t.Errorf("call after Close returned %v, want ErrClosed", err)
+	}
+	if _, err = fdfsClient.getStoragePool("127.0.0.1", 23000); err != ErrClosed {
+		t.Errorf("getStoragePool after Close returned %v, want ErrClosed", err)
+	}
+	fdfsClient.Close()
+}
+
+func TestStorageIds(t *testing.T) {
+	file, err := ioutil.TempFile("", "storage_ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`# <id> <group_name> <ip_or_hostname[:port]>
+100001   group1  192.168.0.196
+100002   group1  192.168.0.197,10.0.0.197:23000
+`)
+	file.Close()
+
+	ids, err := LoadStorageIds(file.Name())
+	if err != nil {
+		t.Errorf("LoadStorageIds error %s", err.Error())
+		return
+	}
+	if info, ok := ids.ById("100002"); !ok || info.IpAddr() != "192.168.0.197" || info.Port != 23000 || len(info.IpAddrs) != 2 {
+		t.Errorf("storage 100002 loaded as %+v", info)
+	}
+	if id := ids.resolve("group1", "10.0.0.197"); id != "100002" {
+		t.Errorf("resolve 10.0.0.197 = %s, want 100002", id)
+	}
+	if id := ids.resolve("group2", "192.168.0.196"); id != "192.168.0.196" {
+		t.Errorf("resolve resolved an address of another group to %s", id)
+	}
+
+	fdfsClient, err := NewFdfsClientByTracker(&Tracker{[]string{"127.0.0.1"}, []int{22122}}, WithStorageIds(ids))
+	if err != nil {
+		t.Errorf("NewFdfsClientByTracker error %s", err.Error())
+		return
+	}
+	defer fdfsClient.Close()
+	name := make([]byte, 20)
+	binary.LittleEndian.PutUint32(name[0:4], 100001)
+	binary.BigEndian.PutUint64(name[8:16], 42)
+	fileId := "group1/M00/00/00/" + coder.EncodeToString(name)[:FDFS_FILENAME_BASE64_LENGTH] + ".txt"
+	info, err := fdfsClient.GetFileInfo(fileId)
+	if err != nil {
+		t.Errorf("GetFileInfo error %s", err.Error())
+		return
+	}
+	if info.SourceStorageId != "100001" || info.SourceIpAddr != "192.168.0.196" {
+		t.Errorf("source of %s resolved to %q/%q", fileId, info.SourceStorageId, info.SourceIpAddr)
+	}
 }
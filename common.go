@@ -1,132 +1,236 @@
 package fdfs_client
 
 import (
-	"errors"
+	"bufio"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
-var (
-	MAXCONN int
-	MINCONN int
-)
+// MAX_CONF_INCLUDE_DEPTH bounds nested #include directives, against include loops.
+const MAX_CONF_INCLUDE_DEPTH = 8
 
+// Config holds the settings of client.conf, see LoadConfig for the other
+// places they can come from. The file uses the format of the FastDFS C client:
+// key = value lines, # comments, tracker_server repeated once per tracker and
+// #include directives naming other files to read in place.
 type Config struct {
 	TrackerIp   []string
 	TrackerPort []int
 	MaxConn     int
 	MinConn     int
-	Net_Timeout int
-	Con_Timeout int
+	Net_Timeout int // seconds
+	Con_Timeout int // seconds
+
+	BasePath                  string
+	LogLevel                  string
+	UseStorageId              bool
+	StorageIdsFilename        string
+	HttpTrackerServerPort     int
+	UseConnectionPool         bool
+	ConnectionPoolMaxIdleTime int // seconds
+
+	// Items holds every key that was set with its values in order, including
+	// keys this client does not use.
+	Items map[string][]string
+}
+
+// DefaultConfig returns the settings used for keys a configuration leaves out.
+// Start from it when filling in a Config by hand.
+func DefaultConfig() *Config {
+	return &Config{
+		MaxConn:                   DEFAULT_MAX_CONNS,
+		MinConn:                   DEFAULT_MIN_CONNS,
+		Net_Timeout:               int(DEFAULT_NETWORK_TIMEOUT.Seconds()),
+		Con_Timeout:               int(DEFAULT_CONNECT_TIMEOUT.Seconds()),
+		LogLevel:                  "info",
+		StorageIdsFilename:        "storage_ids.conf",
+		HttpTrackerServerPort:     80,
+		ConnectionPoolMaxIdleTime: 3600,
+		Items:                     make(map[string][]string),
+	}
 }
 
 func getConf(ConfPath string) (*Config, error) {
-	//logger.Debug("getConf begin")
-	fc := &FdfsConfigParser{}
-	cf, err := fc.Read(ConfPath)
+	Config, err := LoadConfig(FromFile(ConfPath))
 	if err != nil {
 		logger.Errorf("Read conf error :%s", err)
 		return nil, err
 	}
+	return Config, nil
+}
 
-	trackerListString, _ := cf.RawString("DEFAULT", "tracker_server")
-	trackerList := strings.Split(trackerListString, ",")
-
-	max_conn, _ := cf.RawString("DEFAULT", "max_conn")
-
-	network_timeout, _ := cf.RawString("DEFAULT", "network_timeout")
-
-	connect_timeout, _ := cf.RawString("DEFAULT", "connect_timeout")
-
-	min_conn, _ := cf.RawString("DEFAULT", "min_conn")
-
-	var (
-		trackerIpList   []string
-		trackerPortList []int
-		maxc            int
-		minc            int
-		nt              int
-		ct              int
-	)
+// buildConfig makes a Config of the values of client.conf keys.
+func buildConfig(items map[string][]string) (*Config, error) {
+	Config := DefaultConfig()
+	Config.Items = items
+
+	for _, trackerList := range items["tracker_server"] {
+		// a comma separated list is accepted as well
+		for _, tr := range strings.Split(trackerList, ",") {
+			tr = strings.TrimSpace(tr)
+			if tr == "" {
+				continue
+			}
+			trackerIp, port, err := net.SplitHostPort(tr)
+			if err != nil {
+				return nil, &ConfigError{Key: "tracker_server", Value: tr, Reason: "expect host:port"}
+			}
+			trackerPort, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, &ConfigError{Key: "tracker_server", Value: tr, Reason: "invalid port"}
+			}
+			Config.TrackerIp = append(Config.TrackerIp, trackerIp)
+			Config.TrackerPort = append(Config.TrackerPort, trackerPort)
+		}
+	}
 
-	maxc, err = conv2int(max_conn, 0)
-	if err != nil {
+	var err error
+	ints := []struct {
+		key   string
+		value *int
+	}{
+		{"max_conn", &Config.MaxConn},
+		{"min_conn", &Config.MinConn},
+		{"network_timeout", &Config.Net_Timeout},
+		{"connect_timeout", &Config.Con_Timeout},
+		{"http.tracker_server_port", &Config.HttpTrackerServerPort},
+		{"connection_pool_max_idle_time", &Config.ConnectionPoolMaxIdleTime},
+	}
+	for _, item := range ints {
+		if *item.value, err = confInt(items, item.key, *item.value); err != nil {
+			return nil, err
+		}
+	}
+	if Config.UseStorageId, err = confBool(items, "use_storage_id", Config.UseStorageId); err != nil {
 		return nil, err
 	}
-
-	nt, err = conv2int(network_timeout, 1)
-	if err != nil {
+	if Config.UseConnectionPool, err = confBool(items, "use_connection_pool", Config.UseConnectionPool); err != nil {
 		return nil, err
 	}
+	Config.BasePath = confString(items, "base_path", Config.BasePath)
+	Config.LogLevel = confString(items, "log_level", Config.LogLevel)
+	Config.StorageIdsFilename = confString(items, "storage_ids_filename", Config.StorageIdsFilename)
 
-	ct, err = conv2int(connect_timeout, 2)
-	if err != nil {
+	if err = Config.Validate(); err != nil {
 		return nil, err
 	}
+	return Config, nil
+}
 
-	minc, err = conv2int(min_conn, 3)
-	if err != nil {
-		return nil, err
+// Validate checks the settings, e.g. of a Config filled in by hand, and
+// reports the first invalid one as a *ConfigError.
+func (this *Config) Validate() error {
+	if len(this.TrackerIp) == 0 {
+		return &ConfigError{Key: "tracker_server", Reason: "no tracker server"}
 	}
-	for _, tr := range trackerList {
-		var trackerIp string
-		var trackerPort int
-		tr = strings.TrimSpace(tr)
-		parts := strings.Split(tr, ":")
-		if len(parts) != 2 {
-			return nil, errors.New("Wrong format with section 'tracker_server' of config file")
+	if len(this.TrackerIp) != len(this.TrackerPort) {
+		return &ConfigError{Key: "tracker_server", Reason: "TrackerIp and TrackerPort differ in length"}
+	}
+	for i, trackerIp := range this.TrackerIp {
+		if trackerIp == "" || this.TrackerPort[i] <= 0 || this.TrackerPort[i] > 65535 {
+			return &ConfigError{Key: "tracker_server",
+				Value: net.JoinHostPort(trackerIp, strconv.Itoa(this.TrackerPort[i])), Reason: "invalid address"}
 		}
-		trackerIp = parts[0]
+	}
+	if this.MaxConn <= 0 {
+		return &ConfigError{Key: "max_conn", Value: strconv.Itoa(this.MaxConn), Reason: "must be positive"}
+	}
+	if this.MinConn < 0 || this.MinConn > this.MaxConn {
+		return &ConfigError{Key: "min_conn", Value: strconv.Itoa(this.MinConn), Reason: "must be between 0 and max_conn"}
+	}
+	if this.Net_Timeout < 0 {
+		return &ConfigError{Key: "network_timeout", Value: strconv.Itoa(this.Net_Timeout), Reason: "must not be negative"}
+	}
+	if this.Con_Timeout < 0 {
+		return &ConfigError{Key: "connect_timeout", Value: strconv.Itoa(this.Con_Timeout), Reason: "must not be negative"}
+	}
+	if this.HttpTrackerServerPort < 0 || this.HttpTrackerServerPort > 65535 {
+		return &ConfigError{Key: "http.tracker_server_port", Value: strconv.Itoa(this.HttpTrackerServerPort), Reason: "invalid port"}
+	}
+	if this.ConnectionPoolMaxIdleTime < 0 {
+		return &ConfigError{Key: "connection_pool_max_idle_time", Value: strconv.Itoa(this.ConnectionPoolMaxIdleTime),
+			Reason: "must not be negative"}
+	}
+	if this.UseStorageId && this.StorageIdsFilename == "" {
+		return &ConfigError{Key: "storage_ids_filename", Reason: "required with use_storage_id"}
+	}
+	return nil
+}
 
-		//if len(parts) == 2 {
-		trackerPort, err := strconv.Atoi(parts[1]) //append(trackerPort, parts[1])
-		if err != nil {
-			return nil, errors.New("Wrong format with section 'ip port' of config file")
+// readConfFile adds the key = value lines of filename to items. An #include
+// path is relative to the directory of the file that includes it.
+func readConfFile(filename string, items map[string][]string, depth int) error {
+	if depth > MAX_CONF_INCLUDE_DEPTH {
+		return fmt.Errorf("%s: #include nested too deep", filename)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#include") && len(line) > len("#include") &&
+			(line[len("#include")] == ' ' || line[len("#include")] == '\t') {
+			included := strings.TrimSpace(line[len("#include"):])
+			if !filepath.IsAbs(included) {
+				included = filepath.Join(filepath.Dir(filename), included)
+			}
+			if err = readConfFile(included, items, depth+1); err != nil {
+				return err
+			}
+			continue
 		}
-
-		/*} else if len(parts > 2) {
-
-																																																																																																																}*/
-		//if trackerIp != "" {
-		trackerIpList = append(trackerIpList, trackerIp)
-		//}
-
-		//if trackerPort !=
-		trackerPortList = append(trackerPortList, trackerPort)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: expect key=value, got %q", filename, lineNo, line)
+		}
+		key := strings.TrimSpace(line[:i])
+		items[key] = append(items[key], strings.TrimSpace(line[i+1:]))
 	}
+	return scanner.Err()
+}
 
-	Config := &Config{
-		TrackerIp:   trackerIpList,
-		TrackerPort: trackerPortList,
-		MaxConn:     maxc,
-		MinConn:     minc,
-		Net_Timeout: nt,
-		Con_Timeout: ct,
+// confString returns the last value of key, as later lines override earlier ones.
+func confString(items map[string][]string, key string, def string) string {
+	values := items[key]
+	if len(values) == 0 {
+		return def
 	}
-	MAXCONN = maxc
-	MINCONN = minc
-	return Config, nil
-
+	return values[len(values)-1]
 }
 
-func conv2int(stringname string, id int) (int, error) {
-	i, err := strconv.Atoi(stringname)
-	var name string
-	switch id {
-	case 0:
-		name = "max_conn"
-	case 1:
-		name = "network_timeout"
-	case 2:
-		name = "connect_timeout"
-	case 3:
-		name = "min_conn"
-	default:
-		return -1, fmt.Errorf("wrong id number %d", id)
+func confInt(items map[string][]string, key string, def int) (int, error) {
+	value := confString(items, key, "")
+	if value == "" {
+		return def, nil
 	}
+	i, err := strconv.Atoi(value)
 	if err != nil {
-		return -1, fmt.Errorf("Wrong format with section '%s' of config file", name)
+		return -1, &ConfigError{Key: key, Value: value, Reason: "expect an integer"}
 	}
 	return i, nil
 }
+
+// confBool accepts the boolean spellings of the C client.
+func confBool(items map[string][]string, key string, def bool) (bool, error) {
+	value := confString(items, key, "")
+	switch strings.ToLower(value) {
+	case "":
+		return def, nil
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, &ConfigError{Key: key, Value: value, Reason: "expect a boolean"}
+}
@@ -2,6 +2,9 @@ package fdfs_client
 
 import (
 	//"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -20,3 +23,159 @@ func TestGetConf(t *testing.T) {
 	t.Log(Config.Net_Timeout)
 	t.Log(Config.Con_Timeout)
 }
+
+func TestGetConfCClientFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdfs_conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confPath := filepath.Join(dir, "client.conf")
+	ioutil.WriteFile(confPath, []byte(`# connect timeout in seconds
+connect_timeout = 5
+network_timeout=60
+base_path = /opt/fastdfs
+tracker_server = 10.0.0.1:22122
+tracker_server=10.0.0.2:22122
+use_storage_id = true
+use_connection_pool = false
+connection_pool_max_idle_time = 3600
+##include http.conf
+#include http.conf
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "http.conf"), []byte("http.tracker_server_port=8080\n"), 0644)
+
+	Config, err := getConf(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Config.TrackerIp) != 2 || Config.TrackerIp[1] != "10.0.0.2" || Config.TrackerPort[1] != 22122 {
+		t.Errorf("trackers %v %v, want both tracker_server lines", Config.TrackerIp, Config.TrackerPort)
+	}
+	if Config.Con_Timeout != 5 || Config.Net_Timeout != 60 || Config.BasePath != "/opt/fastdfs" {
+		t.Errorf("parsed %+v", Config)
+	}
+	if !Config.UseStorageId || Config.UseConnectionPool || Config.ConnectionPoolMaxIdleTime != 3600 {
+		t.Errorf("parsed %+v", Config)
+	}
+	if Config.HttpTrackerServerPort != 8080 {
+		t.Errorf("http.tracker_server_port %d from #include, want 8080", Config.HttpTrackerServerPort)
+	}
+	if Config.StorageIdsFilename != "storage_ids.conf" {
+		t.Errorf("storage_ids_filename %s without the key, want the default", Config.StorageIdsFilename)
+	}
+	if Config.MaxConn != DEFAULT_MAX_CONNS {
+		t.Errorf("max_conn %d without the key, want %d", Config.MaxConn, DEFAULT_MAX_CONNS)
+	}
+
+	// a file that leaves storage_ids_filename out keeps the value of an earlier source
+	os.Setenv("FDFS_STORAGE_IDS_FILENAME", "/etc/fdfs/storage_ids.conf")
+	defer os.Unsetenv("FDFS_STORAGE_IDS_FILENAME")
+	if Config, err = LoadConfig(FromEnv(), FromFile(confPath)); err != nil {
+		t.Fatal(err)
+	}
+	if Config.StorageIdsFilename != "/etc/fdfs/storage_ids.conf" {
+		t.Errorf("storage_ids_filename %s, want the one of the environment", Config.StorageIdsFilename)
+	}
+
+	// a relative one in the file is next to it
+	ioutil.WriteFile(filepath.Join(dir, "ids.conf"), []byte("tracker_server = 10.0.0.1:22122\nstorage_ids_filename = ids\n"), 0644)
+	if Config, err = getConf(filepath.Join(dir, "ids.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if Config.StorageIdsFilename != filepath.Join(dir, "ids") {
+		t.Errorf("storage_ids_filename %s, want it next to the file", Config.StorageIdsFilename)
+	}
+}
+
+func TestLoadConfigSources(t *testing.T) {
+	os.Setenv("FDFS_TRACKER_SERVERS", "10.0.0.3:22122, 10.0.0.4:22122")
+	os.Setenv("FDFS_MAX_CONN", "50")
+	defer os.Unsetenv("FDFS_TRACKER_SERVERS")
+	defer os.Unsetenv("FDFS_MAX_CONN")
+
+	jsonDoc := []byte(`{"tracker_server": ["10.0.0.1:22122"], "max_conn": 30, "min_conn": 2, "use_storage_id": true}`)
+	Config, err := LoadConfig(FromJSON(jsonDoc), FromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Config.TrackerIp) != 2 || Config.TrackerIp[0] != "10.0.0.3" {
+		t.Errorf("trackers %v, want FDFS_TRACKER_SERVERS to replace the JSON list", Config.TrackerIp)
+	}
+	if Config.MaxConn != 50 || Config.MinConn != 2 || !Config.UseStorageId {
+		t.Errorf("parsed %+v", Config)
+	}
+
+	yamlDoc := []byte("tracker_server:\n  - 10.0.0.1:22122\n  - 10.0.0.2:22122\nnetwork_timeout: 10\n")
+	Config, err = LoadConfig(FromYAML(yamlDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Config.TrackerIp) != 2 || Config.Net_Timeout != 10 || Config.MaxConn != DEFAULT_MAX_CONNS {
+		t.Errorf("parsed %+v", Config)
+	}
+}
+
+func TestLoadConfigFromConfig(t *testing.T) {
+	os.Setenv("FDFS_TRACKER_SERVERS", "10.0.0.3:22122")
+	os.Setenv("FDFS_MAX_CONN", "50")
+	defer os.Unsetenv("FDFS_TRACKER_SERVERS")
+	defer os.Unsetenv("FDFS_MAX_CONN")
+
+	loaded, err := LoadConfig(FromEnv(), FromConfig(&Config{MaxConn: 10, Net_Timeout: 5, UseStorageId: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.TrackerIp) != 1 || loaded.TrackerIp[0] != "10.0.0.3" || loaded.MaxConn != 10 ||
+		loaded.Net_Timeout != 5 || !loaded.UseStorageId {
+		t.Errorf("parsed %+v", loaded)
+	}
+
+	_, err = LoadConfig(FromEnv(), FromConfig(&Config{TrackerIp: []string{"10.0.0.1"}}))
+	if configErr, ok := err.(*ConfigError); !ok || configErr.Key != "tracker_server" {
+		t.Errorf("error %v, want a ConfigError for tracker_server", err)
+	}
+	_, err = LoadConfig(FromEnv(), FromConfig(&Config{}, "max_con"))
+	if configErr, ok := err.(*ConfigError); !ok || configErr.Key != "max_con" {
+		t.Errorf("error %v, want a ConfigError for max_con", err)
+	}
+
+	// zero values override only the keys named
+	dir, err := ioutil.TempDir("", "fdfs_conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confPath := filepath.Join(dir, "client.conf")
+	ioutil.WriteFile(confPath, []byte("tracker_server = 10.0.0.1:22122\nuse_storage_id = true\nmin_conn = 2\n"), 0644)
+	if loaded, err = LoadConfig(FromFile(confPath), FromConfig(&Config{})); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.UseStorageId || loaded.MinConn != 2 {
+		t.Errorf("zero fields replaced the file: %+v", loaded)
+	}
+	if loaded, err = LoadConfig(FromFile(confPath), FromConfig(&Config{}, "use_storage_id", "min_conn")); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.UseStorageId || loaded.MinConn != 0 || len(loaded.TrackerIp) != 1 {
+		t.Errorf("use_storage_id and min_conn not turned off: %+v", loaded)
+	}
+}
+
+func TestConfigErrorKey(t *testing.T) {
+	docs := map[string]string{
+		`{"tracker_server": "10.0.0.1:22122", "max_conn": "many"}`:    "max_conn",
+		`{"tracker_server": "10.0.0.1"}`:                              "tracker_server",
+		`{"tracker_server": "10.0.0.1:22122", "min_conn": 30}`:        "min_conn",
+		`{"tracker_server": "10.0.0.1:22122", "base_path": {"a": 1}}`: "base_path",
+		`{}`: "tracker_server",
+		`{"tracker_server": "10.0.0.1:22122", "max_con": 10}`: "max_con",
+	}
+	for doc, key := range docs {
+		_, err := LoadConfig(FromJSON([]byte(doc)))
+		if configErr, ok := err.(*ConfigError); !ok || configErr.Key != key {
+			t.Errorf("%s: error %v, want a ConfigError for %s", doc, err, key)
+		}
+	}
+}
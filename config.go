@@ -0,0 +1,134 @@
+package fdfs_client
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	DEFAULT_MIN_CONNS = 0
+	DEFAULT_MAX_CONNS = 20
+)
+
+// ClientConfig holds the settings of one FdfsClient. They apply to its tracker
+// pool and to every storage pool it opens, so that several clients in one
+// process can talk to different clusters with different settings.
+type ClientConfig struct {
+	// MinConns connections are opened when a pool is created, MaxConns is the
+	// most a pool keeps open at a time.
+	MinConns int
+	MaxConns int
+	// ConnectTimeout limits dialing and NetworkTimeout any single read or
+	// write; zero disables the limit.
+	ConnectTimeout time.Duration
+	NetworkTimeout time.Duration
+	// RetryPolicy applies to downloads and UploadRetryPolicy to uploads, which
+	// are only retried after connection errors.
+	RetryPolicy       RetryPolicy
+	UploadRetryPolicy RetryPolicy
+	// VerifyChecksum turns on CRC32 checks, see WithVerifyChecksum.
+	VerifyChecksum bool
+	// StorageIds, for clusters with use_storage_id=true, resolves the storage
+	// ids in file ids and lets admin calls take IP addresses in place of ids.
+	StorageIds *StorageIds
+	// Logger receives the log output of the client and its pools.
+	Logger *logrus.Logger
+}
+
+// ClientOption changes a setting of a ClientConfig.
+type ClientOption func(*ClientConfig)
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		MinConns:          DEFAULT_MIN_CONNS,
+		MaxConns:          DEFAULT_MAX_CONNS,
+		ConnectTimeout:    DEFAULT_CONNECT_TIMEOUT,
+		NetworkTimeout:    DEFAULT_NETWORK_TIMEOUT,
+		RetryPolicy:       DefaultRetryPolicy,
+		UploadRetryPolicy: DefaultRetryPolicy,
+		Logger:            logger,
+	}
+}
+
+func WithMinConns(minConns int) ClientOption {
+	return func(config *ClientConfig) {
+		config.MinConns = minConns
+	}
+}
+
+func WithMaxConns(maxConns int) ClientOption {
+	return func(config *ClientConfig) {
+		config.MaxConns = maxConns
+	}
+}
+
+func WithTimeouts(connectTimeout time.Duration, networkTimeout time.Duration) ClientOption {
+	return func(config *ClientConfig) {
+		config.ConnectTimeout = connectTimeout
+		config.NetworkTimeout = networkTimeout
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy for downloads.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(config *ClientConfig) {
+		config.RetryPolicy = policy
+	}
+}
+
+// WithUploadRetryPolicy replaces DefaultRetryPolicy for uploads.
+func WithUploadRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(config *ClientConfig) {
+		config.UploadRetryPolicy = policy
+	}
+}
+
+// WithVerifyChecksum turns on CRC32 checks: uploads compare the CRC32 of the
+// bytes sent with the one encoded in the new file id, and downloads of whole
+// files compare the CRC32 of the bytes received with it. A mismatch is reported
+// as *ErrChecksumMismatch; a corrupt upload is deleted. Appender files carry no
+// usable CRC32 and slave files carry their master's, so neither is checked.
+func WithVerifyChecksum(verify bool) ClientOption {
+	return func(config *ClientConfig) {
+		config.VerifyChecksum = verify
+	}
+}
+
+func WithStorageIds(ids *StorageIds) ClientOption {
+	return func(config *ClientConfig) {
+		config.StorageIds = ids
+	}
+}
+
+// WithLogger replaces the package logger for the client; nil is ignored.
+func WithLogger(l *logrus.Logger) ClientOption {
+	return func(config *ClientConfig) {
+		if l != nil {
+			config.Logger = l
+		}
+	}
+}
+
+// WithConfig replaces all settings at once, e.g. with a ClientConfig built by hand.
+func WithConfig(c ClientConfig) ClientOption {
+	return func(config *ClientConfig) {
+		l := config.Logger
+		*config = c
+		if config.Logger == nil {
+			config.Logger = l
+		}
+	}
+}
+
+func (this *ClientConfig) apply(opts []ClientOption) {
+	for _, opt := range opts {
+		opt(this)
+	}
+}
+
+// newPool opens a connection pool to hosts with the settings of the config.
+func (this *ClientConfig) newPool(hosts []string, ports []int) (*ConnectionPool, error) {
+	return newConnectionPool(hosts, ports, this.MinConns, this.MaxConns,
+		this.ConnectTimeout, this.NetworkTimeout, this.Logger)
+}
@@ -0,0 +1,226 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CONF_KEYS are the client.conf keys a ConfigSource other than a file can set;
+// a JSON or YAML document with any other key is rejected.
+var CONF_KEYS = []string{
+	"tracker_server",
+	"max_conn",
+	"min_conn",
+	"connect_timeout",
+	"network_timeout",
+	"base_path",
+	"log_level",
+	"use_storage_id",
+	"storage_ids_filename",
+	"http.tracker_server_port",
+	"use_connection_pool",
+	"connection_pool_max_idle_time",
+}
+
+// ConfigSource adds the settings it knows of, by client.conf key, to items.
+type ConfigSource func(items map[string][]string) error
+
+// LoadConfig builds a Config from sources. A key set by a later source replaces
+// the values of earlier ones, and DefaultConfig supplies the keys none of them
+// set, so LoadConfig(FromFile(path), FromEnv()) lets the environment override
+// client.conf. Options passed to NewFdfsClientByConfig override the result in
+// turn. Invalid settings are reported as a *ConfigError.
+func LoadConfig(sources ...ConfigSource) (*Config, error) {
+	items := make(map[string][]string)
+	for _, source := range sources {
+		set := make(map[string][]string)
+		if err := source(set); err != nil {
+			return nil, err
+		}
+		for key, values := range set {
+			items[key] = values
+		}
+	}
+	return buildConfig(items)
+}
+
+// FromFile reads a client.conf. A relative storage_ids_filename in it is taken
+// relative to the file, as in the C client.
+func FromFile(confPath string) ConfigSource {
+	return func(items map[string][]string) error {
+		if err := readConfFile(confPath, items, 0); err != nil {
+			return err
+		}
+		filename := confString(items, "storage_ids_filename", "")
+		if filename != "" && !filepath.IsAbs(filename) {
+			items["storage_ids_filename"] = []string{filepath.Join(filepath.Dir(confPath), filename)}
+		}
+		return nil
+	}
+}
+
+// FromEnv reads the variable FDFS_<KEY> for each of CONF_KEYS, where KEY is
+// the key in upper case with dots replaced by underscores, e.g. FDFS_MAX_CONN.
+// Trackers are set with FDFS_TRACKER_SERVERS as a comma separated list.
+func FromEnv() ConfigSource {
+	return func(items map[string][]string) error {
+		for _, key := range CONF_KEYS {
+			if value, ok := os.LookupEnv(confEnvName(key)); ok {
+				items[key] = []string{value}
+			}
+		}
+		return nil
+	}
+}
+
+func confEnvName(key string) string {
+	if key == "tracker_server" {
+		return "FDFS_TRACKER_SERVERS"
+	}
+	return "FDFS_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// FromJSON reads a JSON object keyed like client.conf, for example
+// {"tracker_server": ["10.0.0.1:22122", "10.0.0.2:22122"], "max_conn": 20}.
+// A list gives a key several values.
+func FromJSON(data []byte) ConfigSource {
+	return func(items map[string][]string) error {
+		var doc map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return fmt.Errorf("invalid JSON config: %s", err.Error())
+		}
+		return addConfDocument(items, doc)
+	}
+}
+
+// FromYAML reads a YAML mapping keyed like client.conf, see FromJSON.
+func FromYAML(data []byte) ConfigSource {
+	return func(items map[string][]string) error {
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("invalid YAML config: %s", err.Error())
+		}
+		return addConfDocument(items, doc)
+	}
+}
+
+// FromConfig sets the fields of config that are not zero, so that a Config
+// filled in by hand, e.g. &Config{MaxConn: 50}, can take part in LoadConfig.
+// A zero field, including a false bool, counts as unset and keeps the value of
+// earlier sources or the default, unless its client.conf key is among keys:
+// FromConfig(&Config{}, "use_storage_id") turns use_storage_id off.
+func FromConfig(config *Config, keys ...string) ConfigSource {
+	return func(items map[string][]string) error {
+		override := make(map[string]bool)
+		for _, key := range keys {
+			if !isConfKey(key) {
+				return &ConfigError{Key: key, Reason: "unknown key"}
+			}
+			override[key] = true
+		}
+		set := func(key string, values []string, zero bool) {
+			if !zero || override[key] {
+				items[key] = values
+			}
+		}
+
+		if len(config.TrackerIp) != len(config.TrackerPort) {
+			return &ConfigError{Key: "tracker_server", Reason: "TrackerIp and TrackerPort differ in length"}
+		}
+		var trackers []string
+		for i, trackerIp := range config.TrackerIp {
+			trackers = append(trackers, net.JoinHostPort(trackerIp, strconv.Itoa(config.TrackerPort[i])))
+		}
+		set("tracker_server", trackers, len(trackers) == 0)
+
+		ints := []struct {
+			key   string
+			value int
+		}{
+			{"max_conn", config.MaxConn},
+			{"min_conn", config.MinConn},
+			{"network_timeout", config.Net_Timeout},
+			{"connect_timeout", config.Con_Timeout},
+			{"http.tracker_server_port", config.HttpTrackerServerPort},
+			{"connection_pool_max_idle_time", config.ConnectionPoolMaxIdleTime},
+		}
+		for _, item := range ints {
+			set(item.key, []string{strconv.Itoa(item.value)}, item.value == 0)
+		}
+		strs := []struct {
+			key   string
+			value string
+		}{
+			{"base_path", config.BasePath},
+			{"log_level", config.LogLevel},
+			{"storage_ids_filename", config.StorageIdsFilename},
+		}
+		for _, item := range strs {
+			set(item.key, []string{item.value}, item.value == "")
+		}
+		set("use_storage_id", []string{strconv.FormatBool(config.UseStorageId)}, !config.UseStorageId)
+		set("use_connection_pool", []string{strconv.FormatBool(config.UseConnectionPool)}, !config.UseConnectionPool)
+		return nil
+	}
+}
+
+func addConfDocument(items map[string][]string, doc map[string]interface{}) error {
+	for key, value := range doc {
+		if !isConfKey(key) {
+			return &ConfigError{Key: key, Reason: "unknown key"}
+		}
+		var values []string
+		if list, ok := value.([]interface{}); ok {
+			for _, v := range list {
+				s, ok := confScalar(v)
+				if !ok {
+					return &ConfigError{Key: key, Value: fmt.Sprint(v), Reason: "expect a scalar list item"}
+				}
+				values = append(values, s)
+			}
+		} else if s, ok := confScalar(value); ok {
+			values = []string{s}
+		} else {
+			return &ConfigError{Key: key, Value: fmt.Sprint(value), Reason: "expect a scalar or a list"}
+		}
+		items[key] = values
+	}
+	return nil
+}
+
+func isConfKey(key string) bool {
+	for _, k := range CONF_KEYS {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func confScalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
@@ -1,33 +1,173 @@
 package fdfs_client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/Sirupsen/logrus"
 )
 
 var ErrClosed = errors.New("pool is closed")
 
+const (
+	TCP_SEND_CHUNK_SIZE = 64 * 1024
+
+	// defaults of connect_timeout and network_timeout in client.conf
+	DEFAULT_CONNECT_TIMEOUT = 30 * time.Second
+	DEFAULT_NETWORK_TIMEOUT = 30 * time.Second
+)
+
 type pConn struct {
 	net.Conn
-	pool *ConnectionPool
+	pool    *ConnectionPool
+	ctx     context.Context
+	timeout time.Duration
+	release func() bool
+	broken  bool
 }
 
-func (c pConn) Close() error {
+func (c *pConn) Close() error {
+	if c.release() || c.broken {
+		// the protocol state of an interrupted or failed connection is unknown
+		return c.Conn.Close()
+	}
 	return c.pool.put(c.Conn)
 }
 
+// discard closes the underlying connection instead of returning it to the pool.
+func (c *pConn) discard() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *pConn) Read(b []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(c.ioDeadline())
+		if err := c.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(b)
+	return n, c.checkErr(err)
+}
+
+func (c *pConn) Write(b []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetWriteDeadline(c.ioDeadline())
+		if err := c.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Write(b)
+	return n, c.checkErr(err)
+}
+
+// ReadFrom hands io.Copy to the underlying connection so that uploads from an
+// *os.File can go through sendfile, TCP_SEND_CHUNK_SIZE bytes per write deadline.
+func (c *pConn) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := c.Conn.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+
+	// unwrap the limit so the underlying connection still sees the *os.File
+	lr, ok := r.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: r, N: math.MaxInt64}
+	}
+	var total int64
+	for lr.N > 0 {
+		chunk := &io.LimitedReader{R: lr.R, N: TCP_SEND_CHUNK_SIZE}
+		if lr.N < chunk.N {
+			chunk.N = lr.N
+		}
+		if c.timeout > 0 {
+			c.Conn.SetWriteDeadline(c.ioDeadline())
+			if err := c.ctx.Err(); err != nil {
+				return total, err
+			}
+		}
+		n, err := rf.ReadFrom(chunk)
+		total += n
+		lr.N -= n
+		if err != nil {
+			return total, c.checkErr(err)
+		}
+		if chunk.N > 0 {
+			break
+		}
+	}
+	return total, nil
+}
+
+// invalidate makes closing conn drop it instead of returning it to its pool,
+// for requests abandoned halfway.
+func invalidate(conn net.Conn) {
+	if c, ok := conn.(*pConn); ok {
+		c.broken = true
+	}
+}
+
+// ioDeadline bounds the next read or write by the network timeout and ctx's deadline.
+func (c *pConn) ioDeadline() time.Time {
+	deadline := time.Now().Add(c.timeout)
+	if ctxDeadline, ok := c.ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// checkErr marks the connection unusable after an I/O error and reports the
+// context error in place of the I/O error it caused.
+func (c *pConn) checkErr(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	c.broken = true
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	// the I/O deadline may expire just before the context notices its own
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if deadline, ok := c.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+type timeoutsKey struct{}
+
+type callTimeouts struct {
+	connectTimeout time.Duration
+	networkTimeout time.Duration
+}
+
+// WithCallTimeouts returns a copy of ctx that overrides the pool's connect and
+// network timeouts for calls made with it. A zero duration keeps the pool setting.
+func WithCallTimeouts(ctx context.Context, connectTimeout, networkTimeout time.Duration) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, callTimeouts{connectTimeout, networkTimeout})
+}
+
 type ConnectionPool struct {
-	hosts     []string
-	ports     []int
-	minConns  int
-	maxConns  int
-	busyConns []bool
-	conns     chan net.Conn
+	hosts          []string
+	ports          []int
+	minConns       int
+	maxConns       int
+	connectTimeout time.Duration
+	networkTimeout time.Duration
+	conns          chan net.Conn
+	mu             sync.RWMutex // guards conns against Close
+	logger         *logrus.Logger
 }
 
 func minInt(a int, b int) int {
@@ -39,22 +179,37 @@ func minInt(a int, b int) int {
 }
 
 func NewConnectionPool(hosts []string, ports []int, minConns int, maxConns int) (*ConnectionPool, error) {
+	return NewConnectionPoolWithTimeouts(hosts, ports, minConns, maxConns, DEFAULT_CONNECT_TIMEOUT, DEFAULT_NETWORK_TIMEOUT)
+}
+
+// NewConnectionPoolWithTimeouts is like NewConnectionPool but dials within
+// connectTimeout and fails any single read or write that stalls for networkTimeout.
+// A zero timeout disables the limit.
+func NewConnectionPoolWithTimeouts(hosts []string, ports []int, minConns int, maxConns int,
+	connectTimeout time.Duration, networkTimeout time.Duration) (*ConnectionPool, error) {
+	return newConnectionPool(hosts, ports, minConns, maxConns, connectTimeout, networkTimeout, logger)
+}
+
+func newConnectionPool(hosts []string, ports []int, minConns int, maxConns int,
+	connectTimeout time.Duration, networkTimeout time.Duration, logger *logrus.Logger) (*ConnectionPool, error) {
 	if minConns < 0 || maxConns <= 0 || minConns > maxConns {
 		err := errors.New("invalid conns settings")
 		logger.Error(err.Error())
 		return nil, err
 	}
 	cp := &ConnectionPool{
-		hosts:     hosts,
-		ports:     ports,
-		minConns:  minConns,
-		maxConns:  maxConns,
-		conns:     make(chan net.Conn, maxConns),
-		busyConns: make([]bool, len(hosts)),
+		hosts:          hosts,
+		ports:          ports,
+		minConns:       minConns,
+		maxConns:       maxConns,
+		connectTimeout: connectTimeout,
+		networkTimeout: networkTimeout,
+		conns:          make(chan net.Conn, maxConns),
+		logger:         logger,
 	}
 	//logger.Debug("cp made")
-	for i := 0; i < minInt(MINCONN, len(hosts)); i++ {
-		conn, err := cp.makeConn()
+	for i := 0; i < minInt(minConns, len(hosts)); i++ {
+		conn, err := cp.makeConn(context.Background())
 		if err != nil {
 			cp.Close()
 			logger.Error("make connection error" + err.Error())
@@ -66,6 +221,16 @@ func NewConnectionPool(hosts []string, ports []int, minConns int, maxConns int)
 }
 
 func (this *ConnectionPool) Get() (net.Conn, error) {
+	return this.GetContext(context.Background())
+}
+
+// GetContext returns a pooled connection bound to ctx: dialing honours ctx, its
+// deadline applies to every read and write, and cancelling it aborts pending I/O
+// with ctx.Err(). The binding ends when the connection is closed.
+func (this *ConnectionPool) GetContext(ctx context.Context) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	conns := this.getConns()
 	if conns == nil {
 		return nil, ErrClosed
@@ -75,24 +240,31 @@ func (this *ConnectionPool) Get() (net.Conn, error) {
 		select {
 		case conn := <-conns:
 			if conn == nil {
-				break
-				//return nil, ErrClosed
+				return nil, ErrClosed
 			}
-			if err := this.activeConn(conn); err != nil {
+			pc := this.wrapConn(conn, ctx)
+			if err := this.activeConn(pc); err != nil {
+				pc.discard()
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
 				break
 			}
-			return this.wrapConn(conn), nil
+			return pc, nil
 		default:
 			if this.Len() >= this.maxConns {
 				errmsg := fmt.Sprintf("Too many connctions %d", this.Len())
 				return nil, errors.New(errmsg)
 			}
-			conn, err := this.makeConn()
+			conn, err := this.makeConn(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
 				return nil, err
 			}
 
-			this.conns <- conn
+			this.put(conn)
 			//put connection to pool and go next `for` loop
 			//return this.wrapConn(conn), nil
 		}
@@ -101,15 +273,17 @@ func (this *ConnectionPool) Get() (net.Conn, error) {
 }
 
 func (this *ConnectionPool) Close() {
+	this.mu.Lock()
 	conns := this.conns
 	this.conns = nil
-
 	if conns == nil {
+		this.mu.Unlock()
 		return
 	}
-
 	close(conns)
-	logger.Debugf("%d", len(conns))
+	this.mu.Unlock()
+
+	this.logger.Debugf("%d", len(conns))
 	for conn := range conns {
 		conn.Close()
 	}
@@ -119,23 +293,35 @@ func (this *ConnectionPool) Len() int {
 	return len(this.getConns())
 }
 
-func (this *ConnectionPool) makeConn() (net.Conn, error) {
-	var n int
-	for {
-		n = rand.Intn(len(this.hosts))
-		if !this.busyConns[n] {
-			this.busyConns[n] = true
-			break
-		}
+// makeConn dials the pool's hosts starting from a random one and returns the
+// first connection that succeeds.
+func (this *ConnectionPool) makeConn(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: this.connectTimeout}
+	if timeouts, ok := ctx.Value(timeoutsKey{}).(callTimeouts); ok && timeouts.connectTimeout > 0 {
+		dialer.Timeout = timeouts.connectTimeout
 	}
-	host := this.hosts[n]
-	addr := fmt.Sprintf("%s:%d", host, this.ports[n])
 
-	return net.DialTimeout("tcp", addr, time.Minute)
+	var err error
+	start := rand.Intn(len(this.hosts))
+	for i := 0; i < len(this.hosts); i++ {
+		n := (start + i) % len(this.hosts)
+		addr := net.JoinHostPort(this.hosts[n], strconv.Itoa(this.ports[n]))
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, "tcp", addr); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		this.logger.Warnf("connect to %s error :%s", addr, err.Error())
+	}
+	return nil, err
 }
 
 func (this *ConnectionPool) getConns() chan net.Conn {
+	this.mu.RLock()
 	conns := this.conns
+	this.mu.RUnlock()
 	return conns
 }
 
@@ -143,6 +329,8 @@ func (this *ConnectionPool) put(conn net.Conn) error {
 	if conn == nil {
 		return errors.New("connection is nil")
 	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
 	if this.conns == nil {
 		return conn.Close()
 	}
@@ -155,17 +343,61 @@ func (this *ConnectionPool) put(conn net.Conn) error {
 	}
 }
 
-func (this *ConnectionPool) wrapConn(conn net.Conn) net.Conn {
-	c := pConn{pool: this}
+func (this *ConnectionPool) wrapConn(conn net.Conn, ctx context.Context) *pConn {
+	c := &pConn{pool: this, ctx: ctx, timeout: this.networkTimeout}
+	if timeouts, ok := ctx.Value(timeoutsKey{}).(callTimeouts); ok && timeouts.networkTimeout > 0 {
+		c.timeout = timeouts.networkTimeout
+	}
 	c.Conn = conn
+	c.release = bindContext(ctx, conn)
 	return c
 }
 
+// bindContext applies ctx's deadline to conn and interrupts its pending I/O once
+// ctx is done. The returned func undoes the binding and reports whether ctx fired.
+func bindContext(ctx context.Context, conn net.Conn) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	stop := make(chan struct{})
+	fired := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			fired <- true
+		case <-stop:
+			fired <- false
+		}
+	}()
+
+	var (
+		once        sync.Once
+		interrupted bool
+	)
+	return func() bool {
+		once.Do(func() {
+			close(stop)
+			interrupted = <-fired
+			conn.SetDeadline(time.Time{})
+		})
+		return interrupted
+	}
+}
+
 func (this *ConnectionPool) activeConn(conn net.Conn) error {
 	th := &trackerHeader{}
 	th.cmd = FDFS_PROTO_CMD_ACTIVE_TEST
-	th.sendHeader(conn)
-	th.recvHeader(conn)
+	if err := th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err := th.recvHeader(conn); err != nil {
+		return err
+	}
 	if th.cmd == 100 && th.status == 0 {
 		return nil
 	}
@@ -181,10 +413,10 @@ func TcpSendData(conn net.Conn, bytesStream []byte) error {
 
 func TcpSendFile(conn net.Conn, filename string) error {
 	file, err := os.Open(filename)
-	defer file.Close()
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	var fileSize int64 = 0
 	if fileInfo, err := file.Stat(); err == nil {
@@ -196,47 +428,59 @@ func TcpSendFile(conn net.Conn, filename string) error {
 		return errors.New(errmsg)
 	}
 
-	fileBuffer := make([]byte, fileSize)
+	return TcpSendReader(conn, file, fileSize)
+}
 
-	_, err = file.Read(fileBuffer)
+// TcpSendReader streams exactly size bytes from r to conn, TCP_SEND_CHUNK_SIZE bytes at a time,
+// so the payload is never held in memory as a whole.
+func TcpSendReader(conn net.Conn, r io.Reader, size int64) error {
+	buf := make([]byte, TCP_SEND_CHUNK_SIZE)
+	n, err := io.CopyBuffer(conn, io.LimitReader(r, size), buf)
+	if err == nil && n != size {
+		err = fmt.Errorf("reader ended after %d of %d bytes", n, size)
+	}
 	if err != nil {
-		return err
+		// the server is still waiting for the rest of the body
+		invalidate(conn)
 	}
-
-	return TcpSendData(conn, fileBuffer)
+	return err
 }
 
 func TcpRecvResponse(conn net.Conn, bufferSize int64) ([]byte, int64, error) {
-	recvBuff := make([]byte, 0, bufferSize)
-	tmp := make([]byte, 256)
-	var total int64
-	for {
-		n, err := conn.Read(tmp)
-		total += int64(n)
-		recvBuff = append(recvBuff, tmp[:n]...)
-		if err != nil {
-			if err != io.EOF {
-				return nil, 0, err
-			}
-			break
-		}
-		if total == bufferSize {
-			break
-		}
+	recvBuff := make([]byte, bufferSize)
+	n, err := io.ReadFull(conn, recvBuff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, err
+	}
+	return recvBuff[:n], int64(n), nil
+}
+
+// TcpRecvToWriter copies exactly bufferSize bytes of response body from conn to w.
+func TcpRecvToWriter(conn net.Conn, w io.Writer, bufferSize int64) (int64, error) {
+	total, err := io.CopyN(w, conn, bufferSize)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	return recvBuff, total, nil
+	return total, err
 }
 
 func TcpRecvFile(conn net.Conn, localFilename string, bufferSize int64) (int64, error) {
 	file, err := os.Create(localFilename)
-	defer file.Close()
 	if err != nil {
 		return 0, err
 	}
+	defer file.Close()
 
-	recvBuff, total, err := TcpRecvResponse(conn, bufferSize)
-	if _, err := file.Write(recvBuff); err != nil {
+	return TcpRecvToWriter(conn, file, bufferSize)
+}
+
+// tcpRecvFileWithChecksum is TcpRecvFile that also feeds the bytes to checksum.
+func tcpRecvFileWithChecksum(conn net.Conn, localFilename string, bufferSize int64, checksum io.Writer) (int64, error) {
+	file, err := os.Create(localFilename)
+	if err != nil {
 		return 0, err
 	}
-	return total, nil
+	defer file.Close()
+
+	return TcpRecvToWriter(conn, io.MultiWriter(file, checksum), bufferSize)
 }
@@ -1,8 +1,12 @@
 package fdfs_client
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func getConn(pool *ConnectionPool) {
@@ -71,3 +75,72 @@ func BenchmarkGetConnection(b *testing.B) {
 		go getConn(pool)
 	}
 }
+
+func TestGetConnectionContextCanceled(t *testing.T) {
+	Config, err := getConf("client.conf")
+	if err != nil {
+		t.Error(err)
+	}
+	pool, err := NewConnectionPool(Config.TrackerIp, Config.TrackerPort, Config.MinConn, Config.MaxConn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = pool.GetContext(ctx); err != context.Canceled {
+		t.Errorf("GetContext error %v, want %v", err, context.Canceled)
+	}
+}
+
+// stallingServer answers active tests and never replies to anything else.
+func stallingServer(t *testing.T) (string, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				header := make([]byte, 10)
+				for {
+					if _, err := c.Read(header); err != nil {
+						return
+					}
+					if header[8] == FDFS_PROTO_CMD_ACTIVE_TEST {
+						c.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, TRACKER_PROTO_CMD_RESP, 0})
+					}
+				}
+			}(c)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func TestCallNetworkTimeout(t *testing.T) {
+	host, port := stallingServer(t)
+	pool, err := NewConnectionPoolWithTimeouts([]string{host}, []int{port}, 0, 1, time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	tc := &TrackerClient{pool}
+	ctx := WithCallTimeouts(context.Background(), 0, 100*time.Millisecond)
+	start := time.Now()
+	_, err = tc.trackerQueryStorageStorWithoutGroup(ctx)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("query error %v, want a network timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("query took %v", elapsed)
+	}
+}
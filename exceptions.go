@@ -1 +1,31 @@
 package fdfs_client
+
+import "fmt"
+
+// ErrChecksumMismatch is returned when the CRC32 of the bytes sent or received
+// differs from the one the storage server recorded for the file.
+type ErrChecksumMismatch struct {
+	RemoteFileId string
+	Expected     uint32 // as recorded by the storage server
+	Actual       uint32 // as computed by the client
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("crc32 mismatch on %s: storage server has %08x, client computed %08x",
+		e.RemoteFileId, e.Expected, e.Actual)
+}
+
+// ConfigError reports an invalid or missing configuration setting. Key is the
+// client.conf name of the setting, whatever source it came from.
+type ConfigError struct {
+	Key    string
+	Value  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("config %s: %s", e.Key, e.Reason)
+	}
+	return fmt.Sprintf("config %s = %q: %s", e.Key, e.Value, e.Reason)
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
-	"os"
+	"strconv"
+	"time"
 )
 
 const (
@@ -83,6 +85,8 @@ const (
 	STORAGE_PROTO_CMD_TRUNCATE_FILE      = 36 //since V3.08
 	STORAGE_PROTO_CMD_SYNC_TRUNCATE_FILE = 37 //since V3.08
 
+	STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME = 38 //since V5.x, rename appender file to normal file
+
 	//for overwrite all old metadata
 	STORAGE_SET_METADATA_FLAG_OVERWRITE     = 'O'
 	STORAGE_SET_METADATA_FLAG_OVERWRITE_STR = "O"
@@ -122,13 +126,21 @@ const (
 	FDFS_UPLOAD_BY_FILE     = 3
 	FDFS_DOWNLOAD_TO_BUFFER = 1
 	FDFS_DOWNLOAD_TO_FILE   = 2
+	FDFS_DOWNLOAD_TO_WRITER = 3
 
 	FDFS_NORMAL_LOGIC_FILENAME_LENGTH = (FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH + FDFS_FILE_EXT_NAME_MAX_LEN + 1)
 
 	FDFS_TRUNK_FILENAME_LENGTH       = (FDFS_TRUE_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH + FDFS_TRUNK_FILE_INFO_LEN + 1 + FDFS_FILE_EXT_NAME_MAX_LEN)
 	FDFS_TRUNK_LOGIC_FILENAME_LENGTH = (FDFS_TRUNK_FILENAME_LENGTH + (FDFS_LOGIC_FILE_PATH_LEN - FDFS_TRUE_FILE_PATH_LEN))
 
-	FDFS_VERSION_SIZE = 6
+	// flags in the file size encoded in a remote filename
+	FDFS_APPENDER_FILE_SIZE   = 1 << 58
+	FDFS_TRUNK_FILE_MARK_SIZE = 1 << 59
+
+	FDFS_MAX_SERVER_ID = (1 << 24) - 1
+
+	FDFS_VERSION_SIZE        = 6
+	FDFS_STORAGE_ID_MAX_SIZE = 16
 
 	TRACKER_QUERY_STORAGE_FETCH_BODY_LEN = (FDFS_GROUP_NAME_MAX_LEN + IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE)
 	TRACKER_QUERY_STORAGE_STORE_BODY_LEN = (FDFS_GROUP_NAME_MAX_LEN + IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE + 1)
@@ -164,6 +176,28 @@ type StorageServer struct {
 	storePathIndex int
 }
 
+func (this *StorageServer) IpAddr() string {
+	return this.ipAddr
+}
+
+func (this *StorageServer) Port() int {
+	return this.port
+}
+
+func (this *StorageServer) GroupName() string {
+	return this.groupName
+}
+
+// StorePathIndex is the store path an upload should go to; it is only set for
+// servers returned by store queries.
+func (this *StorageServer) StorePathIndex() int {
+	return this.storePathIndex
+}
+
+func (this *StorageServer) String() string {
+	return net.JoinHostPort(this.ipAddr, strconv.Itoa(this.port))
+}
+
 type trackerHeader struct {
 	pkgLen int64
 	cmd    int8
@@ -191,22 +225,20 @@ func (this *trackerHeader) unmarshal(data []byte) error {
 	return nil
 }
 
-func (this *trackerHeader) sendHeader(conn net.Conn) {
+func (this *trackerHeader) sendHeader(conn net.Conn) error {
 	buf, _ := this.marshal()
-	conn.Write(buf)
+	_, err := conn.Write(buf)
+	return err
 }
 
-func (this *trackerHeader) recvHeader(conn net.Conn) {
+func (this *trackerHeader) recvHeader(conn net.Conn) error {
 	buf := make([]byte, 10)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
-		return
+		return err
 	}
 
-	err = this.unmarshal(buf)
-	if err != nil {
-		return
-	}
+	return this.unmarshal(buf)
 }
 
 type uploadFileRequest struct {
@@ -289,7 +321,7 @@ func (this *UploadFileResponse) unmarshal(data []byte) error {
 		return err
 	}
 	remoteFilename := string(data[len(data)-buff.Len():])
-	this.RemoteFileId = this.GroupName + string(os.PathSeparator) + remoteFilename
+	this.RemoteFileId = joinFileId(this.GroupName, remoteFilename)
 	return nil
 }
 
@@ -369,9 +401,10 @@ func (this *downloadFileRequest) marshal() ([]byte, error) {
 }
 
 type DownloadFileResponse struct {
-	RemoteFileId string
-	Content      interface{}
-	DownloadSize int64
+	RemoteFileId  string
+	Content       interface{}
+	DownloadSize  int64
+	StorageServer *StorageServer // the replica that served the download
 }
 
 type truncFileRequest struct {
@@ -414,3 +447,335 @@ func (this *modifyFileRequst) marshal() ([]byte, error) {
 	}
 	return buffer.Bytes(), nil
 }
+
+type createLinkRequest struct {
+	masterFilename string
+	sourceFilename string
+	sourceFileSig  string
+	groupName      string
+	prefixName     string
+	fileExtName    string
+}
+
+func (this *createLinkRequest) marshal() ([]byte, error) {
+	if len(this.prefixName) > FDFS_FILE_PREFIX_MAX_LEN {
+		return nil, fmt.Errorf("prefix name %q longer than %d", this.prefixName, FDFS_FILE_PREFIX_MAX_LEN)
+	}
+	if len(this.fileExtName) > FDFS_FILE_EXT_NAME_MAX_LEN {
+		return nil, fmt.Errorf("file ext name %q longer than %d", this.fileExtName, FDFS_FILE_EXT_NAME_MAX_LEN)
+	}
+	// #link_fmt: |-master_len(8)-source_len(8)-sig_len(8)-group_name(16)-prefix_name(16)
+	//       #     -file_ext_name(6)-master_filename-source_filename-source_sig-|
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int64(len(this.masterFilename)))
+	binary.Write(buffer, binary.BigEndian, int64(len(this.sourceFilename)))
+	binary.Write(buffer, binary.BigEndian, int64(len(this.sourceFileSig)))
+	writeFixedString(buffer, this.groupName, FDFS_GROUP_NAME_MAX_LEN)
+	writeFixedString(buffer, this.prefixName, FDFS_FILE_PREFIX_MAX_LEN)
+	writeFixedString(buffer, this.fileExtName, FDFS_FILE_EXT_NAME_MAX_LEN)
+	buffer.WriteString(this.masterFilename)
+	buffer.WriteString(this.sourceFilename)
+	buffer.WriteString(this.sourceFileSig)
+	return buffer.Bytes(), nil
+}
+
+type setMetadataRequest struct {
+	groupName      string
+	remoteFilename string
+	opFlag         byte
+	metaData       map[string]string
+}
+
+// #meta_fmt: |-filename_len(8)-meta_len(8)-op_flag(1)-group_name(16)
+// #           -filename(filename_len)-meta_data(meta_len)-|
+func (this *setMetadataRequest) marshal() ([]byte, error) {
+	if this.opFlag != STORAGE_SET_METADATA_FLAG_OVERWRITE && this.opFlag != STORAGE_SET_METADATA_FLAG_MERGE {
+		return nil, fmt.Errorf("invalid metadata op flag %q", this.opFlag)
+	}
+	metaBuff, err := packMetadata(this.metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int64(len(this.remoteFilename)))
+	binary.Write(buffer, binary.BigEndian, int64(len(metaBuff)))
+	buffer.WriteByte(this.opFlag)
+	writeFixedString(buffer, this.groupName, FDFS_GROUP_NAME_MAX_LEN)
+	buffer.WriteString(this.remoteFilename)
+	buffer.Write(metaBuff)
+	return buffer.Bytes(), nil
+}
+
+type getMetadataRequest struct {
+	groupName      string
+	remoteFilename string
+}
+
+// #meta_fmt: |-group_name(16)-filename(len)-|
+func (this *getMetadataRequest) marshal() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	writeFixedString(buffer, this.groupName, FDFS_GROUP_NAME_MAX_LEN)
+	buffer.WriteString(this.remoteFilename)
+	return buffer.Bytes(), nil
+}
+
+type GetMetadataResponse struct {
+	RemoteFileId string
+	MetaData     map[string]string
+}
+
+// recv_fmt: |-name(FIELD_SEPERATOR)value(RECORD_SEPERATOR)...-|
+func (this *GetMetadataResponse) unmarshal(data []byte) error {
+	metaData, err := unpackMetadata(data)
+	if err != nil {
+		return err
+	}
+	this.MetaData = metaData
+	return nil
+}
+
+// GroupStat is one group as listed by the tracker.
+type GroupStat struct {
+	GroupName          string
+	TotalMB            int64
+	FreeMB             int64
+	TrunkFreeMB        int64
+	StorageCount       int
+	StoragePort        int
+	StorageHttpPort    int
+	ActiveCount        int
+	CurrentWriteServer int
+	StorePathCount     int
+	SubdirCountPerPath int
+	CurrentTrunkFileId int64
+}
+
+// groupStatBuff is the wire layout of GroupStat, 105 bytes.
+type groupStatBuff struct {
+	GroupName          [FDFS_GROUP_NAME_MAX_LEN + 1]byte
+	TotalMB            int64
+	FreeMB             int64
+	TrunkFreeMB        int64
+	Count              int64
+	StoragePort        int64
+	StorageHttpPort    int64
+	ActiveCount        int64
+	CurrentWriteServer int64
+	StorePathCount     int64
+	SubdirCountPerPath int64
+	CurrentTrunkFileId int64
+}
+
+// recv_fmt: |-group_stat(105)-...-|
+func unmarshalGroupStats(data []byte) ([]GroupStat, error) {
+	var buff groupStatBuff
+	size := binary.Size(buff)
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid group list length %d, not a multiple of %d", len(data), size)
+	}
+
+	r := bytes.NewReader(data)
+	stats := make([]GroupStat, 0, len(data)/size)
+	for r.Len() > 0 {
+		if err := binary.Read(r, binary.BigEndian, &buff); err != nil {
+			return nil, err
+		}
+		stats = append(stats, GroupStat{
+			GroupName:          cstr(buff.GroupName[:]),
+			TotalMB:            buff.TotalMB,
+			FreeMB:             buff.FreeMB,
+			TrunkFreeMB:        buff.TrunkFreeMB,
+			StorageCount:       int(buff.Count),
+			StoragePort:        int(buff.StoragePort),
+			StorageHttpPort:    int(buff.StorageHttpPort),
+			ActiveCount:        int(buff.ActiveCount),
+			CurrentWriteServer: int(buff.CurrentWriteServer),
+			StorePathCount:     int(buff.StorePathCount),
+			SubdirCountPerPath: int(buff.SubdirCountPerPath),
+			CurrentTrunkFileId: buff.CurrentTrunkFileId,
+		})
+	}
+	return stats, nil
+}
+
+// StorageCounters are the operation counters a storage server reports to the tracker.
+type StorageCounters struct {
+	TotalUploadCount       int64
+	SuccessUploadCount     int64
+	TotalAppendCount       int64
+	SuccessAppendCount     int64
+	TotalModifyCount       int64
+	SuccessModifyCount     int64
+	TotalTruncateCount     int64
+	SuccessTruncateCount   int64
+	TotalSetMetaCount      int64
+	SuccessSetMetaCount    int64
+	TotalDeleteCount       int64
+	SuccessDeleteCount     int64
+	TotalDownloadCount     int64
+	SuccessDownloadCount   int64
+	TotalGetMetaCount      int64
+	SuccessGetMetaCount    int64
+	TotalCreateLinkCount   int64
+	SuccessCreateLinkCount int64
+	TotalDeleteLinkCount   int64
+	SuccessDeleteLinkCount int64
+	TotalUploadBytes       int64
+	SuccessUploadBytes     int64
+	TotalAppendBytes       int64
+	SuccessAppendBytes     int64
+	TotalModifyBytes       int64
+	SuccessModifyBytes     int64
+	TotalDownloadBytes     int64
+	SuccessDownloadBytes   int64
+	TotalSyncInBytes       int64
+	SuccessSyncInBytes     int64
+	TotalSyncOutBytes      int64
+	SuccessSyncOutBytes    int64
+	TotalFileOpenCount     int64
+	SuccessFileOpenCount   int64
+	TotalFileReadCount     int64
+	SuccessFileReadCount   int64
+	TotalFileWriteCount    int64
+	SuccessFileWriteCount  int64
+}
+
+// StorageStat is one storage server as listed by the tracker.
+type StorageStat struct {
+	Status             int // one of FDFS_STORAGE_STATUS_*
+	Id                 string
+	IpAddr             string
+	DomainName         string
+	SrcId              string // the server this one synced its initial data from
+	Version            string
+	JoinTime           time.Time
+	UpTime             time.Time
+	TotalMB            int64
+	FreeMB             int64
+	UploadPriority     int
+	StorePathCount     int
+	SubdirCountPerPath int
+	CurrentWritePath   int
+	StoragePort        int
+	StorageHttpPort    int
+
+	ConnAllocCount   int
+	ConnCurrentCount int
+	ConnMaxCount     int
+	StorageCounters
+
+	LastSourceUpdate    time.Time
+	LastSyncUpdate      time.Time
+	LastSyncedTimestamp time.Time
+	LastHeartBeatTime   time.Time
+	IfTrunkServer       bool
+}
+
+// StatusName returns the name fdfs_monitor prints for the storage status.
+func (this *StorageStat) StatusName() string {
+	return StorageStatusName(this.Status)
+}
+
+// StorageStatusName returns the name of a FDFS_STORAGE_STATUS_* value.
+func StorageStatusName(status int) string {
+	switch status {
+	case FDFS_STORAGE_STATUS_INIT:
+		return "INIT"
+	case FDFS_STORAGE_STATUS_WAIT_SYNC:
+		return "WAIT_SYNC"
+	case FDFS_STORAGE_STATUS_SYNCING:
+		return "SYNCING"
+	case FDFS_STORAGE_STATUS_IP_CHANGED:
+		return "IP_CHANGED"
+	case FDFS_STORAGE_STATUS_DELETED:
+		return "DELETED"
+	case FDFS_STORAGE_STATUS_OFFLINE:
+		return "OFFLINE"
+	case FDFS_STORAGE_STATUS_ONLINE:
+		return "ONLINE"
+	case FDFS_STORAGE_STATUS_ACTIVE:
+		return "ACTIVE"
+	case FDFS_STORAGE_STATUS_RECOVERY:
+		return "RECOVERY"
+	case FDFS_STORAGE_STATUS_NONE:
+		return "NONE"
+	}
+	return "UNKNOWN"
+}
+
+// storageStatBuff is the wire layout of StorageStat, 612 bytes.
+type storageStatBuff struct {
+	Status             int8
+	Id                 [FDFS_STORAGE_ID_MAX_SIZE]byte
+	IpAddr             [IP_ADDRESS_SIZE]byte
+	DomainName         [FDFS_DOMAIN_NAME_MAX_LEN]byte
+	SrcId              [FDFS_STORAGE_ID_MAX_SIZE]byte
+	Version            [FDFS_VERSION_SIZE]byte
+	JoinTime           int64
+	UpTime             int64
+	TotalMB            int64
+	FreeMB             int64
+	UploadPriority     int64
+	StorePathCount     int64
+	SubdirCountPerPath int64
+	CurrentWritePath   int64
+	StoragePort        int64
+	StorageHttpPort    int64
+
+	ConnAllocCount   int32
+	ConnCurrentCount int32
+	ConnMaxCount     int32
+	Counters         StorageCounters
+
+	LastSourceUpdate    int64
+	LastSyncUpdate      int64
+	LastSyncedTimestamp int64
+	LastHeartBeatTime   int64
+	IfTrunkServer       int8
+}
+
+// recv_fmt: |-storage_stat(612)-...-|
+func unmarshalStorageStats(data []byte) ([]StorageStat, error) {
+	var buff storageStatBuff
+	size := binary.Size(buff)
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid storage list length %d, not a multiple of %d", len(data), size)
+	}
+
+	r := bytes.NewReader(data)
+	stats := make([]StorageStat, 0, len(data)/size)
+	for r.Len() > 0 {
+		if err := binary.Read(r, binary.BigEndian, &buff); err != nil {
+			return nil, err
+		}
+		stats = append(stats, StorageStat{
+			Status:              int(buff.Status),
+			Id:                  cstr(buff.Id[:]),
+			IpAddr:              cstr(buff.IpAddr[:]),
+			DomainName:          cstr(buff.DomainName[:]),
+			SrcId:               cstr(buff.SrcId[:]),
+			Version:             cstr(buff.Version[:]),
+			JoinTime:            unixTime(buff.JoinTime),
+			UpTime:              unixTime(buff.UpTime),
+			TotalMB:             buff.TotalMB,
+			FreeMB:              buff.FreeMB,
+			UploadPriority:      int(buff.UploadPriority),
+			StorePathCount:      int(buff.StorePathCount),
+			SubdirCountPerPath:  int(buff.SubdirCountPerPath),
+			CurrentWritePath:    int(buff.CurrentWritePath),
+			StoragePort:         int(buff.StoragePort),
+			StorageHttpPort:     int(buff.StorageHttpPort),
+			ConnAllocCount:      int(buff.ConnAllocCount),
+			ConnCurrentCount:    int(buff.ConnCurrentCount),
+			ConnMaxCount:        int(buff.ConnMaxCount),
+			StorageCounters:     buff.Counters,
+			LastSourceUpdate:    unixTime(buff.LastSourceUpdate),
+			LastSyncUpdate:      unixTime(buff.LastSyncUpdate),
+			LastSyncedTimestamp: unixTime(buff.LastSyncedTimestamp),
+			LastHeartBeatTime:   unixTime(buff.LastHeartBeatTime),
+			IfTrunkServer:       buff.IfTrunkServer != 0,
+		})
+	}
+	return stats, nil
+}
@@ -0,0 +1,157 @@
+package fdfs_client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FileID is a file id as returned by uploads, made of the group name and the
+// remote filename, e.g. group1/M00/00/03/wKj_glc-fQiEISCUAAAAAChSBpE4174280.txt:
+//
+//	group1  M00  00/03  wKj_glc-fQiEISCUAAAAAChSBpE41742  [trunk info][prefix]  .txt
+//
+// Files stored in a trunk file carry the base64 position in the trunk after the
+// file info, and slave files carry the prefix name they were uploaded with.
+type FileID struct {
+	GroupName      string
+	StorePathIndex int    // the NN of MNN, in hex in the filename
+	Dir            string // two-level directory, e.g. "00/03"
+	Payload        string // base64 file info, see FileInfo
+	TrunkInfo      string // empty unless the file is stored in a trunk file
+	Prefix         string // empty unless the file is a slave file
+	Ext            string // file extension name without the dot
+}
+
+// ParseFileID parses and validates a file id of the form group/remote_filename.
+func ParseFileID(fileId string) (*FileID, error) {
+	i := strings.IndexByte(fileId, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid file id %q: no group name", fileId)
+	}
+	id, err := parseFilename(fileId[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid file id %q: %s", fileId, err.Error())
+	}
+	id.GroupName = fileId[:i]
+	if id.GroupName == "" || len(id.GroupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return nil, fmt.Errorf("invalid file id %q: bad group name length %d", fileId, len(id.GroupName))
+	}
+	return id, nil
+}
+
+// parseFilename parses a remote filename, the file id without its group.
+func parseFilename(remoteFilename string) (*FileID, error) {
+	if len(remoteFilename) < FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH {
+		return nil, fmt.Errorf("remote filename too short: %d bytes", len(remoteFilename))
+	}
+	// #path_fmt: |-M(1)-store_path_index(2)-/(1)-dir1(2)-/(1)-dir2(2)-/(1)-|
+	path := remoteFilename[:FDFS_LOGIC_FILE_PATH_LEN]
+	if path[0] != 'M' || path[3] != '/' || path[6] != '/' || path[9] != '/' ||
+		!isHex(path[1:3]) || !isHex(path[4:6]) || !isHex(path[7:9]) {
+		return nil, fmt.Errorf("bad store path %q", path)
+	}
+	id := &FileID{}
+	storePathIndex, _ := strconv.ParseUint(path[1:3], 16, 8)
+	id.StorePathIndex = int(storePathIndex)
+	id.Dir = path[4:9]
+	id.Payload = remoteFilename[FDFS_LOGIC_FILE_PATH_LEN : FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH]
+	decode, err := coder.DecodeString(id.Payload + "=")
+	if err != nil {
+		return nil, fmt.Errorf("bad file info %q", id.Payload)
+	}
+	isTrunk := binary.BigEndian.Uint64(decode[8:16])&FDFS_TRUNK_FILE_MARK_SIZE != 0
+
+	rest := remoteFilename[FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH:]
+	if dot := strings.LastIndexByte(rest, '.'); dot >= 0 {
+		id.Ext = rest[dot+1:]
+		rest = rest[:dot]
+		if id.Ext == "" || len(id.Ext) > FDFS_FILE_EXT_NAME_MAX_LEN {
+			return nil, fmt.Errorf("bad file extension name %q", id.Ext)
+		}
+	}
+	maxLen := FDFS_NORMAL_LOGIC_FILENAME_LENGTH
+	if isTrunk {
+		if len(rest) < FDFS_TRUNK_FILE_INFO_LEN {
+			return nil, fmt.Errorf("trunk info missing")
+		}
+		id.TrunkInfo = rest[:FDFS_TRUNK_FILE_INFO_LEN]
+		rest = rest[FDFS_TRUNK_FILE_INFO_LEN:]
+		maxLen = FDFS_TRUNK_LOGIC_FILENAME_LENGTH
+	}
+	id.Prefix = rest
+	if len(id.Prefix) > FDFS_FILE_PREFIX_MAX_LEN || strings.IndexByte(id.Prefix, '/') >= 0 {
+		return nil, fmt.Errorf("bad prefix name %q", id.Prefix)
+	}
+	if len(remoteFilename)-len(id.Prefix) > maxLen {
+		return nil, fmt.Errorf("remote filename too long: %d bytes", len(remoteFilename))
+	}
+	return id, nil
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Filename returns the remote filename, the file id without its group.
+func (this *FileID) Filename() string {
+	filename := fmt.Sprintf("M%02X/%s/%s%s%s", this.StorePathIndex, this.Dir, this.Payload, this.TrunkInfo, this.Prefix)
+	if this.Ext != "" {
+		filename += "." + this.Ext
+	}
+	return filename
+}
+
+// IsSlave reports whether the file was uploaded as a slave of another file.
+func (this *FileID) IsSlave() bool {
+	return this.Prefix != ""
+}
+
+// hasChecksum reports whether the CRC32 in the file id is that of the file's
+// content: an appender file has no usable one and a slave file its master's.
+func (this *FileID) hasChecksum() bool {
+	return !this.IsSlave() && !this.fileInfo().IsAppender
+}
+
+// fileInfo decodes the payload. The size, create time and CRC32 of an appender,
+// trunk or slave file do not describe its current content.
+func (this *FileID) fileInfo() *FileInfo {
+	// #payload_fmt: |-ip or storage id(4)-create_timestamp(4)-file_size(8)-crc32(4)-|
+	decode, _ := coder.DecodeString(this.Payload + "=")
+	info := &FileInfo{}
+	if id := binary.LittleEndian.Uint32(decode[:4]); id > 0 && id <= FDFS_MAX_SERVER_ID {
+		info.SourceStorageId = strconv.FormatUint(uint64(id), 10)
+	} else {
+		info.SourceIpAddr, _ = inet_ntoa(decode[:4])
+	}
+	info.CreateTime = unixTime(int64(binary.BigEndian.Uint32(decode[4:8])))
+	fileSize := int64(binary.BigEndian.Uint64(decode[8:16]))
+	info.Crc32 = binary.BigEndian.Uint32(decode[16:20])
+
+	info.IsAppender = fileSize&FDFS_APPENDER_FILE_SIZE != 0
+	info.IsTrunk = fileSize&FDFS_TRUNK_FILE_MARK_SIZE != 0
+	info.IsSlave = this.IsSlave()
+	info.FileSize = fileSize
+	// the size of a file with random bits, or of a trunk or appender file,
+	// is in the low 32 bits; a normal file of 4GB or more keeps all 64
+	if uint64(fileSize)>>63 != 0 || info.IsTrunk || info.IsAppender {
+		info.FileSize = fileSize & 0xFFFFFFFF
+	}
+	return info
+}
+
+func (this *FileID) String() string {
+	return joinFileId(this.GroupName, this.Filename())
+}
+
+// joinFileId makes the file id of remoteFilename in groupName.
+func joinFileId(groupName string, remoteFilename string) string {
+	return groupName + "/" + remoteFilename
+}
@@ -0,0 +1,180 @@
+package fdfs_client
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// ParallelDownload downloads remoteFileId to localPath as parts ranged requests,
+// at most concurrency of them at a time, spread over all replicas of the file.
+// A part that fails is retried on the next replica as allowed by the retry
+// policy. The finished file is checked against the size and, unless it is an
+// appender or slave file, the CRC32 the storage server keeps for it.
+func (this *FdfsClient) ParallelDownload(remoteFileId string, localPath string, parts int, concurrency int) (*DownloadFileResponse, error) {
+	return this.ParallelDownloadContext(context.Background(), remoteFileId, localPath, parts, concurrency)
+}
+
+func (this *FdfsClient) ParallelDownloadContext(ctx context.Context, remoteFileId string, localPath string,
+	parts int, concurrency int) (*DownloadFileResponse, error) {
+	ctx, end, err := this.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	fileId, err := ParseFileID(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName := fileId.GroupName
+	remoteFilename := fileId.Filename()
+
+	info, err := this.QueryFileInfoContext(ctx, groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+	tc := &TrackerClient{this.trackerPool}
+	replicas, err := tc.trackerQueryStorageFetchAll(ctx, groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return nil, err
+	}
+	succeeded := false
+	defer func() {
+		file.Close()
+		if !succeeded {
+			os.Remove(localPath)
+		}
+	}()
+	if err = file.Truncate(info.FileSize); err != nil {
+		return nil, err
+	}
+
+	ranges := splitRange(info.FileSize, parts)
+	if concurrency <= 0 || concurrency > len(ranges) {
+		concurrency = len(ranges)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		jobs     = make(chan int)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range jobs {
+				if err := this.downloadPart(ctx, replicas, part, file, ranges[part], remoteFilename); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for part := range ranges {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- part
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if err = verifyLocalFile(file, info, fileId.hasChecksum()); err != nil {
+		return nil, err
+	}
+
+	succeeded = true
+	dr := &DownloadFileResponse{}
+	dr.RemoteFileId = remoteFileId
+	dr.Content = localPath
+	dr.DownloadSize = info.FileSize
+	return dr, nil
+}
+
+// byteRange is the part of a file starting at offset that is size bytes long.
+type byteRange struct {
+	offset int64
+	size   int64
+}
+
+// splitRange divides fileSize bytes into at most parts ranges of nearly equal size.
+func splitRange(fileSize int64, parts int) []byteRange {
+	if parts <= 0 {
+		parts = 1
+	}
+	if int64(parts) > fileSize {
+		parts = int(fileSize)
+	}
+	if parts == 0 {
+		return nil
+	}
+	ranges := make([]byteRange, parts)
+	partSize := fileSize / int64(parts)
+	var offset int64
+	for i := range ranges {
+		size := partSize
+		if int64(i) < fileSize%int64(parts) {
+			size++
+		}
+		ranges[i] = byteRange{offset, size}
+		offset += size
+	}
+	return ranges
+}
+
+// downloadPart fetches one range into file, starting on the replica the part
+// number picks and moving to the next one after a retryable error. A retry
+// continues after the bytes that already arrived.
+func (this *FdfsClient) downloadPart(ctx context.Context, replicas []StorageServer, part int,
+	file *os.File, r byteRange, remoteFilename string) error {
+	w := &offsetWriter{file: file, offset: r.offset}
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := this.config.RetryPolicy.sleep(ctx, attempt); err != nil {
+				return err
+			}
+		}
+		storeServ := &replicas[(part+attempt)%len(replicas)]
+		done := w.offset - r.offset
+		if done == r.size {
+			return nil
+		}
+		err = this.tryStorage(storeServ, func(store *StorageClient, storeServ *StorageServer) error {
+			_, err := store.storageDownloadToWriter(ctx, nil, storeServ, w, r.offset+done, r.size-done, remoteFilename)
+			return err
+		})
+		if err == nil || attempt+1 >= this.config.RetryPolicy.MaxAttempts || !isRetryable(ctx, err) {
+			return err
+		}
+		this.config.Logger.Warnf("retrying part %d of %s after error :%s", part, remoteFilename, err.Error())
+	}
+}
+
+// offsetWriter writes to file sequentially from offset on with WriteAt, so that
+// several of them can fill different parts of the same file concurrently.
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (this *offsetWriter) Write(p []byte) (int, error) {
+	n, err := this.file.WriteAt(p, this.offset)
+	this.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,193 @@
+package fdfs_client
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// RetryPolicy controls how operations that more than one storage server can
+// serve are retried after a failure.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, the first one included.
+	// Values below 1 mean a single try.
+	MaxAttempts int
+	// InitialBackoff is the pause before the second try; it doubles on every
+	// further try up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+}
+
+// backoff returns the pause before try number attempt, counting from 0.
+func (this RetryPolicy) backoff(attempt int) time.Duration {
+	if attempt <= 0 || this.InitialBackoff <= 0 {
+		return 0
+	}
+	d := this.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if this.MaxBackoff > 0 && d >= this.MaxBackoff {
+			return this.MaxBackoff
+		}
+	}
+	if this.MaxBackoff > 0 && d > this.MaxBackoff {
+		return this.MaxBackoff
+	}
+	return d
+}
+
+// sleep waits for the backoff of attempt or until ctx is done.
+func (this RetryPolicy) sleep(ctx context.Context, attempt int) error {
+	d := this.backoff(attempt)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryable reports whether err may not happen again on another try or
+// another storage server: a connection error, or ENOENT from a replica that
+// has not synced the file yet. Local and protocol errors are not.
+func isRetryable(ctx context.Context, err error) bool {
+	if errno, ok := err.(Errno); ok {
+		return errno.status == 2 && ctx.Err() == nil
+	}
+	return isConnError(ctx, err)
+}
+
+// isConnError reports whether err is a network failure talking to a tracker or
+// storage server, after which another server may succeed.
+func isConnError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// withFetchFailover runs op against the storage server the tracker picks for
+// the file. While op fails with a retryable error and the retry policy allows,
+// it runs op again against the next server from QUERY_FETCH_ALL, cycling
+// through the replicas. It returns the server of the last try.
+func (this *FdfsClient) withFetchFailover(ctx context.Context, tc *TrackerClient, groupName string, remoteFilename string,
+	op func(store *StorageClient, storeServ *StorageServer) error) (*StorageServer, error) {
+	storeServ, err := tc.trackerQueryStorageFetch(ctx, groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		replicas []StorageServer
+		lastErr  error
+	)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if replicas == nil {
+				replicas, err = tc.trackerQueryStorageFetchAll(ctx, groupName, remoteFilename)
+				if err != nil || len(replicas) == 0 {
+					return storeServ, lastErr
+				}
+			}
+			// move on to the replica after the one that failed
+			next := 0
+			for i := range replicas {
+				if replicas[i].String() == storeServ.String() {
+					next = (i + 1) % len(replicas)
+					break
+				}
+			}
+			if err = this.config.RetryPolicy.sleep(ctx, attempt); err != nil {
+				return storeServ, err
+			}
+			this.config.Logger.Warnf("retrying %s/%s on %s after error :%s", groupName, remoteFilename, replicas[next].String(), lastErr.Error())
+			storeServ = &replicas[next]
+		}
+
+		lastErr = this.tryStorage(storeServ, op)
+		if lastErr == nil || attempt+1 >= this.config.RetryPolicy.MaxAttempts || !isRetryable(ctx, lastErr) {
+			return storeServ, lastErr
+		}
+	}
+}
+
+func (this *FdfsClient) tryStorage(storeServ *StorageServer, op func(store *StorageClient, storeServ *StorageServer) error) error {
+	storagePool, err := this.getStoragePool(storeServ.ipAddr, storeServ.port)
+	if err != nil {
+		return err
+	}
+	return op(&StorageClient{storagePool, this.config.VerifyChecksum}, storeServ)
+}
+
+// withStoreFailover runs op against the storage server the tracker picks for an
+// upload to groupName, or to any group when it is empty. While op or the tracker
+// query fails with a connection error, the retry policy allows and canRetry (if
+// not nil) agrees, it runs op again against a storage server from the *_ALL store
+// query that has not failed yet. It returns the server of the last try.
+func (this *FdfsClient) withStoreFailover(ctx context.Context, tc *TrackerClient, groupName string,
+	canRetry func() bool, op func(store *StorageClient, storeServ *StorageServer) error) (*StorageServer, error) {
+	var (
+		storeServ *StorageServer
+		failed    = make(map[string]bool)
+		err       error
+	)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := this.config.UploadRetryPolicy.sleep(ctx, attempt); err != nil {
+				return storeServ, err
+			}
+		}
+
+		storeServ, err = this.queryStoreStorage(ctx, tc, groupName, failed)
+		if err == nil {
+			err = this.tryStorage(storeServ, op)
+			if isConnError(ctx, err) {
+				failed[storeServ.String()] = true
+			}
+		}
+		if err == nil || attempt+1 >= this.config.UploadRetryPolicy.MaxAttempts || !isConnError(ctx, err) ||
+			(canRetry != nil && !canRetry()) {
+			return storeServ, err
+		}
+		this.config.Logger.Warnf("retrying upload after error :%s", err.Error())
+	}
+}
+
+// queryStoreStorage asks the tracker for a storage server to upload to, avoiding
+// the failed ones when there are others.
+func (this *FdfsClient) queryStoreStorage(ctx context.Context, tc *TrackerClient, groupName string,
+	failed map[string]bool) (*StorageServer, error) {
+	if len(failed) == 0 {
+		if groupName == "" {
+			return tc.trackerQueryStorageStorWithoutGroup(ctx)
+		}
+		return tc.trackerQueryStorageStorWithGroup(ctx, groupName)
+	}
+
+	storages, err := tc.trackerQueryStorageStorAll(ctx, groupName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range storages {
+		if !failed[storages[i].String()] {
+			return &storages[i], nil
+		}
+	}
+	// every server failed once; try them again in the tracker's order
+	return &storages[0], nil
+}
@@ -2,75 +2,92 @@ package fdfs_client
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"net"
 	"os"
+	"strings"
 )
 
 type StorageClient struct {
-	pool *ConnectionPool
+	pool           *ConnectionPool
+	verifyChecksum bool
 }
 
-func (this *StorageClient) storageUploadByFilename(tc *TrackerClient,
+func (this *StorageClient) storageUploadByFilename(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, filename string) (*UploadFileResponse, error) {
-	fileInfo, err := os.Stat(filename)
+	file, fileSize, err := openUploadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	fileSize := fileInfo.Size()
-	fileExtName := getFileExt(filename)
+	return this.storageUploadByReader(ctx, tc, storeServ, file, fileSize, getFileExt(filename))
+}
 
-	return this.storageUploadFile(tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
+func (this *StorageClient) storageUploadByReader(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, r io.Reader, fileSize int64, fileExtName string) (*UploadFileResponse, error) {
+	return this.storageUploadFile(ctx, tc, storeServ, r, fileSize, FDFS_UPLOAD_BY_FILE,
 		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
 }
 
-func (this *StorageClient) storageUploadByBuffer(tc *TrackerClient,
+func (this *StorageClient) storageUploadByBuffer(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileBuffer []byte, fileExtName string) (*UploadFileResponse, error) {
 	bufferSize := len(fileBuffer)
 
-	return this.storageUploadFile(tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
+	return this.storageUploadFile(ctx, tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
 		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
 }
 
-func (this *StorageClient) storageUploadSlaveByFilename(tc *TrackerClient,
+func (this *StorageClient) storageUploadSlaveByFilename(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, filename string, prefixName string, remoteFileId string) (*UploadFileResponse, error) {
-	fileInfo, err := os.Stat(filename)
+	file, fileSize, err := openUploadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	fileSize := fileInfo.Size()
-	fileExtName := getFileExt(filename)
+	return this.storageUploadSlaveByReader(ctx, tc, storeServ, file, fileSize, prefixName, remoteFileId, getFileExt(filename))
+}
 
-	return this.storageUploadFile(tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
+func (this *StorageClient) storageUploadSlaveByReader(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, r io.Reader, fileSize int64, prefixName string, remoteFileId string,
+	fileExtName string) (*UploadFileResponse, error) {
+	return this.storageUploadFile(ctx, tc, storeServ, r, fileSize, FDFS_UPLOAD_BY_FILE,
 		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, remoteFileId, prefixName, fileExtName)
 }
 
-func (this *StorageClient) storageUploadSlaveByBuffer(tc *TrackerClient,
+func (this *StorageClient) storageUploadSlaveByBuffer(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileBuffer []byte, remoteFileId string, fileExtName string) (*UploadFileResponse, error) {
 	bufferSize := len(fileBuffer)
 
-	return this.storageUploadFile(tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
+	return this.storageUploadFile(ctx, tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
 		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, "", remoteFileId, fileExtName)
 }
 
-func (this *StorageClient) storageUploadAppenderByFilename(tc *TrackerClient,
+func (this *StorageClient) storageUploadAppenderByFilename(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, filename string) (*UploadFileResponse, error) {
-	fileInfo, err := os.Stat(filename)
+	file, fileSize, err := openUploadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	fileSize := fileInfo.Size()
-	fileExtName := getFileExt(filename)
+	return this.storageUploadAppenderByReader(ctx, tc, storeServ, file, fileSize, getFileExt(filename))
+}
 
-	return this.storageUploadFile(tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
+func (this *StorageClient) storageUploadAppenderByReader(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, r io.Reader, fileSize int64, fileExtName string) (*UploadFileResponse, error) {
+	return this.storageUploadFile(ctx, tc, storeServ, r, fileSize, FDFS_UPLOAD_BY_FILE,
 		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
 }
-func (this *StorageClient) storageAppendByfileName(tc *TrackerClient, storeServ *StorageServer, localFileName string,
+
+func (this *StorageClient) storageAppendByfileName(ctx context.Context, tc *TrackerClient, storeServ *StorageServer, localFileName string,
 	groupName string, remoteFileName string) error {
 	if remoteFileName == "" || groupName == " " {
 		return errors.New("Invalid group name or append file name")
@@ -81,10 +98,10 @@ func (this *StorageClient) storageAppendByfileName(tc *TrackerClient, storeServ
 	}
 
 	fileSize := fileInfo.Size()
-	logger.Info("unknown filesize", fileSize)
-	return this.storageDoAppendFile(fileSize, localFileName, groupName, remoteFileName)
+	this.pool.logger.Info("unknown filesize", fileSize)
+	return this.storageDoAppendFile(ctx, fileSize, localFileName, groupName, remoteFileName)
 }
-func (this *StorageClient) storageModifyByfileName(tc *TrackerClient, storeServ *StorageServer, localFileName string,
+func (this *StorageClient) storageModifyByfileName(ctx context.Context, tc *TrackerClient, storeServ *StorageServer, localFileName string,
 	offset int64, groupName string, remoteFileName string) error {
 	if remoteFileName == "" || groupName == " " {
 		return errors.New("Invalid group name or append file name")
@@ -95,18 +112,18 @@ func (this *StorageClient) storageModifyByfileName(tc *TrackerClient, storeServ
 	}
 
 	fileSize := fileInfo.Size()
-	logger.Info("unknown filesize", fileSize)
-	return this.storageDoModifyFile(fileSize, localFileName, offset, groupName, remoteFileName)
+	this.pool.logger.Info("unknown filesize", fileSize)
+	return this.storageDoModifyFile(ctx, fileSize, localFileName, offset, groupName, remoteFileName)
 }
-func (this *StorageClient) storageUploadAppenderByBuffer(tc *TrackerClient,
+func (this *StorageClient) storageUploadAppenderByBuffer(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileBuffer []byte, fileExtName string) (*UploadFileResponse, error) {
 	bufferSize := len(fileBuffer)
 
-	return this.storageUploadFile(tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
+	return this.storageUploadFile(ctx, tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
 		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
 }
 
-func (this *StorageClient) storageUploadFile(tc *TrackerClient,
+func (this *StorageClient) storageUploadFile(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileContent interface{}, fileSize int64, uploadType int,
 	cmd int8, masterFilename string, prefixName string, fileExtName string) (*UploadFileResponse, error) {
 
@@ -118,11 +135,11 @@ func (this *StorageClient) storageUploadFile(tc *TrackerClient,
 		err         error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
 	masterFilenameLen := int64(len(masterFilename))
 	if len(storeServ.groupName) > 0 && len(masterFilename) > 0 {
@@ -136,7 +153,9 @@ func (this *StorageClient) storageUploadFile(tc *TrackerClient,
 	th.pkgLen = headerLen
 	th.pkgLen += int64(fileSize)
 	th.cmd = cmd
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
 	if uploadSlave {
 		req := &uploadSlaveFileRequest{}
@@ -154,185 +173,457 @@ func (this *StorageClient) storageUploadFile(tc *TrackerClient,
 		reqBuf, err = req.marshal()
 	}
 	if err != nil {
-		logger.Warnf("uploadFileRequest.marshal error :%s", err.Error())
+		this.pool.logger.Warnf("uploadFileRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
 		return nil, err
 	}
-	TcpSendData(conn, reqBuf)
 
+	var checksum hash.Hash32
+	// an appender file has no CRC32 yet, a slave file id carries its master's
+	if this.verifyChecksum && cmd != STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE && cmd != STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE {
+		checksum = crc32.NewIEEE()
+	}
 	switch uploadType {
 	case FDFS_UPLOAD_BY_FILENAME:
 		if filename, ok := fileContent.(string); ok {
 			err = TcpSendFile(conn, filename)
 		}
-	case FDFS_DOWNLOAD_TO_BUFFER:
+	case FDFS_UPLOAD_BY_BUFFER:
 		if fileBuffer, ok := fileContent.([]byte); ok {
+			if checksum != nil {
+				checksum.Write(fileBuffer)
+			}
 			err = TcpSendData(conn, fileBuffer)
 		}
+	case FDFS_UPLOAD_BY_FILE:
+		if r, ok := fileContent.(io.Reader); ok {
+			if checksum != nil {
+				r = io.TeeReader(r, checksum)
+			}
+			err = TcpSendReader(conn, r, fileSize)
+		}
 	}
 	if err != nil {
-		logger.Warnf(err.Error())
+		this.pool.logger.Warn(err)
 		return nil, err
 	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
 		return nil, Errno{int(th.status)}
 	}
 	recvBuff, recvSize, err := TcpRecvResponse(conn, th.pkgLen)
-	if recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
+	if err != nil {
+		return nil, err
+	}
+	if recvSize != th.pkgLen || recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
 		errmsg := "[-] Error: Storage response length is not match, "
 		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
-		logger.Warn(errmsg)
+		this.pool.logger.Warn(errmsg)
 		return nil, errors.New(errmsg)
 	}
 	ur := &UploadFileResponse{}
 	err = ur.unmarshal(recvBuff)
 	if err != nil {
 		errmsg := fmt.Sprintf("recvBuf can not unmarshal :%s", err.Error())
-		logger.Warn(errmsg)
+		this.pool.logger.Warn(errmsg)
 		return nil, errors.New(errmsg)
 	}
+	if checksum != nil {
+		if err = this.checkUpload(ctx, tc, storeServ, ur, checksum.Sum32()); err != nil {
+			return nil, err
+		}
+	}
+
+	return ur, nil
+}
+
+// storageCreateLink creates a new file id on storeServ that shares the content
+// of sourceFilename. With a prefixName the link is named as a slave of it.
+func (this *StorageClient) storageCreateLink(ctx context.Context, tc *TrackerClient, storeServ *StorageServer,
+	sourceFilename string, prefixName string, fileExtName string) (*UploadFileResponse, error) {
+	req := &createLinkRequest{}
+	if prefixName != "" {
+		req.masterFilename = sourceFilename
+	}
+	req.sourceFilename = sourceFilename
+	req.groupName = storeServ.groupName
+	req.prefixName = prefixName
+	req.fileExtName = fileExtName
+	reqBuf, err := req.marshal()
+	if err != nil {
+		this.pool.logger.Warnf("createLinkRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+
+	conn, err := this.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_CREATE_LINK
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return nil, err
+	}
 
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		return nil, Errno{int(th.status)}
+	}
+	recvBuff, recvSize, err := TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		return nil, err
+	}
+	if recvSize != th.pkgLen || recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
+		errmsg := "[-] Error: Storage response length is not match, "
+		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
+		this.pool.logger.Warn(errmsg)
+		return nil, errors.New(errmsg)
+	}
+	ur := &UploadFileResponse{}
+	if err = ur.unmarshal(recvBuff); err != nil {
+		return nil, err
+	}
 	return ur, nil
 }
 
-func (this *StorageClient) storageDeleteFile(tc *TrackerClient, storeServ *StorageServer, remoteFilename string) (*DeleteFileResponse, error) {
+// storageRegenerateAppenderFilename turns the appender file into a normal file
+// and returns its new file id.
+func (this *StorageClient) storageRegenerateAppenderFilename(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, appenderFilename string) (*UploadFileResponse, error) {
+	conn, err := this.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// #regen_fmt: |-appender_filename(len)-|
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME
+	th.pkgLen = int64(len(appenderFilename))
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if err = TcpSendData(conn, []byte(appenderFilename)); err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		return nil, Errno{int(th.status)}
+	}
+	recvBuff, recvSize, err := TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		return nil, err
+	}
+	if recvSize != th.pkgLen || recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
+		errmsg := "[-] Error: Storage response length is not match, "
+		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
+		this.pool.logger.Warn(errmsg)
+		return nil, errors.New(errmsg)
+	}
+	ur := &UploadFileResponse{}
+	if err = ur.unmarshal(recvBuff); err != nil {
+		return nil, err
+	}
+	return ur, nil
+}
+
+func (this *StorageClient) storageDeleteFile(ctx context.Context, tc *TrackerClient, storeServ *StorageServer, remoteFilename string) (*DeleteFileResponse, error) {
 	var (
 		conn   net.Conn
 		reqBuf []byte
 		err    error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
 	th := &trackerHeader{}
 	th.cmd = STORAGE_PROTO_CMD_DELETE_FILE
 	fileNameLen := len(remoteFilename)
 	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + fileNameLen)
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
 	req := &deleteFileRequest{}
 	req.groupName = storeServ.groupName
 	req.remoteFilename = remoteFilename
 	reqBuf, err = req.marshal()
 	if err != nil {
-		logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		this.pool.logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
 		return nil, err
 	}
-	TcpSendData(conn, reqBuf)
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
 		return nil, Errno{int(th.status)}
 	}
-	logger.Infof("pkg_len:%d", th.pkgLen)
+	this.pool.logger.Infof("pkg_len:%d", th.pkgLen)
 	/*recvBuff, recvSize, err := TcpRecvResponse(conn, th.pkgLen)
 	if recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
 		errmsg := "[-] Error: Storage response length is not match, "
 		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
-		logger.Warn(errmsg)
+		this.pool.logger.Warn(errmsg)
 		return nil, errors.New(errmsg)
 	}*/
 	dr := &DeleteFileResponse{}
 	/*err = dr.unmarshal(recvBuff)
 	if err != nil {
 		errmsg := fmt.Sprintf("recvBuf can not unmarshal :%s", err.Error())
-		logger.Warn(errmsg)
+		this.pool.logger.Warn(errmsg)
 		return nil, errors.New(errmsg)
 	}*/
 	return dr, nil
 }
 
-func (this *StorageClient) storageDownloadToFile(tc *TrackerClient,
+// checkUpload compares the CRC32 of the bytes sent with the one in the new file
+// id and deletes the file when they differ.
+func (this *StorageClient) checkUpload(ctx context.Context, tc *TrackerClient, storeServ *StorageServer,
+	ur *UploadFileResponse, sum uint32) error {
+	remoteFilename := ur.RemoteFileId[len(ur.GroupName)+1:]
+	info, err := parseRemoteFilename(remoteFilename)
+	if err != nil {
+		return err
+	}
+	if info.Crc32 == sum {
+		return nil
+	}
+	this.pool.logger.Warnf("crc32 mismatch on %s, deleting it", ur.RemoteFileId)
+	if _, err = this.storageDeleteFile(context.Background(), tc, storeServ, remoteFilename); err != nil {
+		this.pool.logger.Warnf("delete %s error :%s", ur.RemoteFileId, err.Error())
+	}
+	return &ErrChecksumMismatch{RemoteFileId: ur.RemoteFileId, Expected: info.Crc32, Actual: sum}
+}
+
+// downloadChecksum returns a hash for the CRC32 check of a download, or nil
+// when the download is not checked: a range, an appender or slave file, or
+// checks off.
+func (this *StorageClient) downloadChecksum(offset int64, downloadSize int64, remoteFilename string) (hash.Hash32, uint32) {
+	if !this.verifyChecksum || offset != 0 || downloadSize != 0 {
+		return nil, 0
+	}
+	fileId, err := parseFilename(remoteFilename)
+	if err != nil || !fileId.hasChecksum() {
+		return nil, 0
+	}
+	return crc32.NewIEEE(), fileId.fileInfo().Crc32
+}
+
+func (this *StorageClient) storageDownloadToFile(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, localFilename string, offset int64,
 	downloadSize int64, remoteFilename string) (*DownloadFileResponse, error) {
-	return this.storageDownloadFile(tc, storeServ, localFilename, offset, downloadSize, FDFS_DOWNLOAD_TO_FILE, remoteFilename)
+	return this.storageDownloadFile(ctx, tc, storeServ, localFilename, offset, downloadSize, FDFS_DOWNLOAD_TO_FILE, remoteFilename)
 }
 
-func (this *StorageClient) storageDownloadToBuffer(tc *TrackerClient,
+func (this *StorageClient) storageDownloadToBuffer(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileBuffer []byte, offset int64,
 	downloadSize int64, remoteFilename string) (*DownloadFileResponse, error) {
-	return this.storageDownloadFile(tc, storeServ, fileBuffer, offset, downloadSize, FDFS_DOWNLOAD_TO_BUFFER, remoteFilename)
+	return this.storageDownloadFile(ctx, tc, storeServ, fileBuffer, offset, downloadSize, FDFS_DOWNLOAD_TO_BUFFER, remoteFilename)
 }
 
-func (this *StorageClient) storageDownloadFile(tc *TrackerClient,
+func (this *StorageClient) storageDownloadToWriter(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, w io.Writer, offset int64,
+	downloadSize int64, remoteFilename string) (*DownloadFileResponse, error) {
+	return this.storageDownloadFile(ctx, tc, storeServ, w, offset, downloadSize, FDFS_DOWNLOAD_TO_WRITER, remoteFilename)
+}
+
+func (this *StorageClient) storageDownloadFile(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileContent interface{}, offset int64, downloadSize int64,
 	downloadType int, remoteFilename string) (*DownloadFileResponse, error) {
 
 	var (
-		conn          net.Conn
-		reqBuf        []byte
-		localFilename string
-		recvBuff      []byte
-		recvSize      int64
-		err           error
+		conn     net.Conn
+		recvBuff []byte
+		recvSize int64
+		bodyLen  int64
+		err      error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
-	th := &trackerHeader{}
-	th.cmd = STORAGE_PROTO_CMD_DOWNLOAD_FILE
-	th.pkgLen = int64(FDFS_PROTO_PKG_LEN_SIZE*2 + FDFS_GROUP_NAME_MAX_LEN + len(remoteFilename))
-	th.sendHeader(conn)
-
-	req := &downloadFileRequest{}
-	req.offset = offset
-	req.downloadSize = downloadSize
-	req.groupName = storeServ.groupName
-	req.remoteFilename = remoteFilename
-	reqBuf, err = req.marshal()
+	bodyLen, err = this.storageSendDownloadRequest(conn, storeServ, offset, downloadSize, remoteFilename)
 	if err != nil {
-		logger.Warnf("downloadFileRequest.marshal error :%s", err.Error())
 		return nil, err
 	}
-	TcpSendData(conn, reqBuf)
-
-	th.recvHeader(conn)
-	if th.status != 0 {
-		return nil, Errno{int(th.status)}
-	}
 
+	checksum, expected := this.downloadChecksum(offset, downloadSize, remoteFilename)
 	switch downloadType {
 	case FDFS_DOWNLOAD_TO_FILE:
 		if localFilename, ok := fileContent.(string); ok {
-			recvSize, err = TcpRecvFile(conn, localFilename, th.pkgLen)
+			if checksum == nil {
+				recvSize, err = TcpRecvFile(conn, localFilename, bodyLen)
+			} else {
+				recvSize, err = tcpRecvFileWithChecksum(conn, localFilename, bodyLen, checksum)
+			}
 		}
 	case FDFS_DOWNLOAD_TO_BUFFER:
 		if _, ok := fileContent.([]byte); ok {
-			recvBuff, recvSize, err = TcpRecvResponse(conn, th.pkgLen)
+			recvBuff, recvSize, err = TcpRecvResponse(conn, bodyLen)
+			if checksum != nil {
+				checksum.Write(recvBuff)
+			}
+		}
+	case FDFS_DOWNLOAD_TO_WRITER:
+		if w, ok := fileContent.(io.Writer); ok {
+			if checksum != nil {
+				w = io.MultiWriter(w, checksum)
+			}
+			recvSize, err = TcpRecvToWriter(conn, w, bodyLen)
 		}
 	}
 	if err != nil {
-		logger.Warnf(err.Error())
+		this.pool.logger.Warn(err)
 		return nil, err
 	}
 	if recvSize < downloadSize {
 		errmsg := "[-] Error: Storage response length is not match, "
-		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
-		logger.Warn(errmsg)
+		errmsg += fmt.Sprintf("expect: %d, actual: %d", bodyLen, recvSize)
+		this.pool.logger.Warn(errmsg)
 		return nil, errors.New(errmsg)
 	}
 
 	dr := &DownloadFileResponse{}
-	dr.RemoteFileId = storeServ.groupName + string(os.PathSeparator) + remoteFilename
-	if downloadType == FDFS_DOWNLOAD_TO_FILE {
-		dr.Content = localFilename
-	} else {
+	dr.RemoteFileId = joinFileId(storeServ.groupName, remoteFilename)
+	if checksum != nil && checksum.Sum32() != expected {
+		return nil, &ErrChecksumMismatch{RemoteFileId: dr.RemoteFileId, Expected: expected, Actual: checksum.Sum32()}
+	}
+	if downloadType == FDFS_DOWNLOAD_TO_BUFFER {
 		dr.Content = recvBuff
+	} else {
+		dr.Content = fileContent
 	}
 	dr.DownloadSize = recvSize
 	return dr, nil
 }
 
-func (this *StorageClient) storageTruncateFile(tc *TrackerClient, storeServ *StorageServer,
+// storageDownloadReader starts a download and returns the body as a reader that
+// owns conn until it is closed.
+func (this *StorageClient) storageDownloadReader(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, offset int64, downloadSize int64, remoteFilename string) (io.ReadCloser, error) {
+	conn, err := this.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyLen, err := this.storageSendDownloadRequest(conn, storeServ, offset, downloadSize, remoteFilename)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	checksum, expected := this.downloadChecksum(offset, downloadSize, remoteFilename)
+	return &downloadReader{conn: conn, remaining: bodyLen, remoteFileId: joinFileId(storeServ.groupName, remoteFilename),
+		checksum: checksum, expected: expected}, nil
+}
+
+// storageSendDownloadRequest sends a download request on conn and returns the
+// length of the file body that follows the response header.
+func (this *StorageClient) storageSendDownloadRequest(conn net.Conn, storeServ *StorageServer,
+	offset int64, downloadSize int64, remoteFilename string) (int64, error) {
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_DOWNLOAD_FILE
+	th.pkgLen = int64(FDFS_PROTO_PKG_LEN_SIZE*2 + FDFS_GROUP_NAME_MAX_LEN + len(remoteFilename))
+	if err := th.sendHeader(conn); err != nil {
+		return 0, err
+	}
+
+	req := &downloadFileRequest{}
+	req.offset = offset
+	req.downloadSize = downloadSize
+	req.groupName = storeServ.groupName
+	req.remoteFilename = remoteFilename
+	reqBuf, err := req.marshal()
+	if err != nil {
+		this.pool.logger.Warnf("downloadFileRequest.marshal error :%s", err.Error())
+		return 0, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return 0, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return 0, err
+	}
+	if th.status != 0 {
+		return 0, Errno{int(th.status)}
+	}
+	return th.pkgLen, nil
+}
+
+type downloadReader struct {
+	conn         net.Conn
+	remaining    int64
+	remoteFileId string
+	checksum     hash.Hash32 // nil unless the download is checked
+	expected     uint32
+}
+
+func (this *downloadReader) Read(p []byte) (int, error) {
+	if this.conn == nil {
+		return 0, ErrClosed
+	}
+	if this.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > this.remaining {
+		p = p[:this.remaining]
+	}
+	n, err := this.conn.Read(p)
+	this.remaining -= int64(n)
+	if err == io.EOF && this.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if this.checksum != nil {
+		this.checksum.Write(p[:n])
+		if this.remaining == 0 && this.checksum.Sum32() != this.expected {
+			err = &ErrChecksumMismatch{RemoteFileId: this.remoteFileId, Expected: this.expected, Actual: this.checksum.Sum32()}
+		}
+	}
+	return n, err
+}
+
+// Close returns the connection to its pool once the body has been read completely.
+// A partially read body leaves the stream unusable, so the connection is dropped instead.
+func (this *downloadReader) Close() error {
+	conn := this.conn
+	if conn == nil {
+		return nil
+	}
+	this.conn = nil
+	if pc, ok := conn.(*pConn); ok && this.remaining > 0 {
+		return pc.discard()
+	}
+	return conn.Close()
+}
+
+func (this *StorageClient) storageTruncateFile(ctx context.Context, tc *TrackerClient, storeServ *StorageServer,
 	appenderFileName string, truncatedFileSize int64) (*DeleteFileResponse, error) {
 	//update connection
 	var (
@@ -341,17 +632,19 @@ func (this *StorageClient) storageTruncateFile(tc *TrackerClient, storeServ *Sto
 		err    error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
 	th := &trackerHeader{}
 	th.cmd = STORAGE_PROTO_CMD_TRUNCATE_FILE
 	appenderFileNameLen := len(appenderFileName)
 	th.pkgLen = int64(FDFS_PROTO_PKG_LEN_SIZE*2 + appenderFileNameLen)
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 	//logger.Info("1111111")
 
 	req := &truncFileRequest{}
@@ -361,22 +654,26 @@ func (this *StorageClient) storageTruncateFile(tc *TrackerClient, storeServ *Sto
 
 	reqBuf, err = req.marshal()
 	if err != nil {
-		logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		this.pool.logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return nil, err
+	}
+	if err = th.recvHeader(conn); err != nil {
 		return nil, err
 	}
-	TcpSendData(conn, reqBuf)
-	th.recvHeader(conn)
 	if th.status != 0 {
 		return nil, Errno{int(th.status)}
 	}
 
-	logger.Infof("pkg_len:%d", th.pkgLen)
+	this.pool.logger.Infof("pkg_len:%d", th.pkgLen)
 
 	/*recvBuff, recvSize, err := TcpRecvResponse(conn, th.pkgLen)
 	if recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
 		errmsg := "[-] Error: Storage response length is not match, "
 		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
-		logger.Warn(errmsg)
+		this.pool.logger.Warn(errmsg)
 		return nil, errors.New(errmsg)
 	}*/
 
@@ -384,29 +681,31 @@ func (this *StorageClient) storageTruncateFile(tc *TrackerClient, storeServ *Sto
 	/*err = dr.unmarshal(recvBuff)
 	if err != nil {
 		errmsg := fmt.Sprintf("recvBuf can not unmarshal :%s", err.Error())
-		logger.Warn(errmsg)
+		this.pool.logger.Warn(errmsg)
 		return nil, errors.New(errmsg)
 	}*/
-	logger.Debug("1")
+	this.pool.logger.Debug("1")
 	return dr, nil
 
 }
-func (this *StorageClient) storageQueryFileInfo(groupName string, remoteFileName string) (*fileInfo, error) {
+func (this *StorageClient) storageQueryFileInfo(ctx context.Context, groupName string, remoteFileName string) (*FileInfo, error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
 		err      error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 	th := &trackerHeader{}
 	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + len(remoteFileName))
 	th.cmd = STORAGE_PROTO_CMD_QUERY_FILE_INFO
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 	queryBuffer := new(bytes.Buffer)
 	// 16 bit groupName
 	groupNameBytes := bytes.NewBufferString(groupName).Bytes()
@@ -427,46 +726,43 @@ func (this *StorageClient) storageQueryFileInfo(groupName string, remoteFileName
 		return nil, err
 	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
-		logger.Warnf("recvHeader error [%d]", th.status)
+		this.pool.logger.Warnf("recvHeader error [%d]", th.status)
 		return nil, Errno{int(th.status)}
 	}
-	var (
-		x               int32
-		createTimeStamp int32
-		crc32           int32
-		fileSize        int64
-		ipAddr          string
-	)
-	logger.Infof("pkg_len:%d", th.pkgLen)
+	// #resp_fmt: |-file_size(8)-create_timestamp(8)-crc32(8)-source_ip_addr(16)-|
 	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
 	if err != nil {
-		logger.Warnf("TcpRecvResponse error :%s", err.Error())
+		this.pool.logger.Warnf("TcpRecvResponse error :%s", err.Error())
 		return nil, err
 	}
-	buff := bytes.NewBuffer(recvBuff)
-	binary.Read(buff, binary.BigEndian, &fileSize)
-	//logger.Infof("filesize:%d", fileSize)
-	binary.Read(buff, binary.BigEndian, &x)
-	binary.Read(buff, binary.BigEndian, &createTimeStamp)
-	//logger.Infof("timestamp:%d", createTimeStamp)
-	binary.Read(buff, binary.BigEndian, &x)
-	binary.Read(buff, binary.BigEndian, &crc32)
-	//logger.Infof("crc32:%d", crc32)
-	ipAddr, err = readCstr(buff, IP_ADDRESS_SIZE-1)
+	if len(recvBuff) < 3*FDFS_PROTO_PKG_LEN_SIZE+IP_ADDRESS_SIZE-1 {
+		return nil, fmt.Errorf("file info response too short: %d bytes", len(recvBuff))
+	}
+	info := &FileInfo{}
+	info.FileSize = int64(binary.BigEndian.Uint64(recvBuff[0:8]))
+	info.CreateTime = unixTime(int64(binary.BigEndian.Uint64(recvBuff[8:16])))
+	info.Crc32 = uint32(binary.BigEndian.Uint64(recvBuff[16:24]))
+	info.SourceIpAddr = cstr(recvBuff[24 : 24+IP_ADDRESS_SIZE-1])
+	return info, nil
+}
+
+func (this *StorageClient) storageDoAppendFile(ctx context.Context, fileSize int64, localFileName string,
+	groupName string, remoteFileName string) error {
+	file, _, err := openUploadFile(localFileName)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	//logger.Info("ip:" + ipAddr)
-	return &fileInfo{createTimeStamp,
-		crc32,
-		0,
-		fileSize,
-		ipAddr}, nil
+	defer file.Close()
 
+	return this.storageAppendByReader(ctx, file, fileSize, groupName, remoteFileName)
 }
-func (this *StorageClient) storageDoAppendFile(fileSize int64, localFileName string,
+
+// storageAppendByReader appends exactly fileSize bytes read from r to the appender file.
+func (this *StorageClient) storageAppendByReader(ctx context.Context, r io.Reader, fileSize int64,
 	groupName string, remoteFileName string) error {
 	var (
 		conn   net.Conn
@@ -474,16 +770,18 @@ func (this *StorageClient) storageDoAppendFile(fileSize int64, localFileName str
 		err    error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 	th := &trackerHeader{}
 	th.cmd = STORAGE_PROTO_CMD_APPEND_FILE
 	appenderFileNameLen := len(remoteFileName)
 	th.pkgLen = int64(FDFS_PROTO_PKG_LEN_SIZE*2+appenderFileNameLen) + fileSize
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
 	req := &truncFileRequest{}
 	req.appendernameLen = int64(appenderFileNameLen)
 	req.truncatedFileSize = fileSize
@@ -491,21 +789,40 @@ func (this *StorageClient) storageDoAppendFile(fileSize int64, localFileName str
 
 	reqBuf, err = req.marshal()
 	if err != nil {
-		logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		this.pool.logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return err
+	}
+	if err = TcpSendReader(conn, r, fileSize); err != nil {
+		return err
+	}
+	if err = th.recvHeader(conn); err != nil {
 		return err
 	}
-	TcpSendData(conn, reqBuf)
-	TcpSendFile(conn, localFileName)
-	th.recvHeader(conn)
 	if th.status != 0 {
 		return Errno{int(th.status)}
 	}
 
-	logger.Infof("pkg_len:%d", th.pkgLen)
+	this.pool.logger.Infof("pkg_len:%d", th.pkgLen)
 
 	return nil
 }
-func (this *StorageClient) storageDoModifyFile(fileSize int64, localFileName string, offset int64,
+
+func (this *StorageClient) storageDoModifyFile(ctx context.Context, fileSize int64, localFileName string, offset int64,
+	groupName string, remoteFileName string) error {
+	file, _, err := openUploadFile(localFileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return this.storageModifyByReader(ctx, file, fileSize, offset, groupName, remoteFileName)
+}
+
+// storageModifyByReader overwrites the appender file from offset with exactly fileSize bytes read from r.
+func (this *StorageClient) storageModifyByReader(ctx context.Context, r io.Reader, fileSize int64, offset int64,
 	groupName string, remoteFileName string) error {
 	var (
 		conn   net.Conn
@@ -513,16 +830,18 @@ func (this *StorageClient) storageDoModifyFile(fileSize int64, localFileName str
 		err    error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 	th := &trackerHeader{}
 	th.cmd = STORAGE_PROTO_CMD_MODIFY_FILE
 	appenderFileNameLen := len(remoteFileName)
 	th.pkgLen = int64(FDFS_PROTO_PKG_LEN_SIZE*3+appenderFileNameLen) + fileSize
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
 	req := &modifyFileRequst{}
 	req.appendernameLen = int64(appenderFileNameLen)
 	req.offset = offset
@@ -531,17 +850,148 @@ func (this *StorageClient) storageDoModifyFile(fileSize int64, localFileName str
 
 	reqBuf, err = req.marshal()
 	if err != nil {
-		logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		this.pool.logger.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return err
+	}
+	if err = TcpSendReader(conn, r, fileSize); err != nil {
+		return err
+	}
+	if err = th.recvHeader(conn); err != nil {
 		return err
 	}
-	TcpSendData(conn, reqBuf)
-	TcpSendFile(conn, localFileName)
-	th.recvHeader(conn)
 	if th.status != 0 {
 		return Errno{int(th.status)}
 	}
 
-	logger.Infof("pkg_len:%d", th.pkgLen)
+	this.pool.logger.Infof("pkg_len:%d", th.pkgLen)
+
+	return nil
+}
+
+func (this *StorageClient) storageSetMetadata(ctx context.Context, tc *TrackerClient, storeServ *StorageServer,
+	remoteFilename string, metaData map[string]string, opFlag byte) error {
+	var (
+		conn   net.Conn
+		reqBuf []byte
+		err    error
+	)
+
+	req := &setMetadataRequest{}
+	req.groupName = storeServ.groupName
+	req.remoteFilename = remoteFilename
+	req.opFlag = opFlag
+	req.metaData = metaData
+	reqBuf, err = req.marshal()
+	if err != nil {
+		this.pool.logger.Warnf("setMetadataRequest.marshal error :%s", err.Error())
+		return err
+	}
+
+	conn, err = this.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_SET_METADATA
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return err
+	}
 
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
+	if th.status != 0 {
+		return Errno{int(th.status)}
+	}
 	return nil
 }
+
+func (this *StorageClient) storageGetMetadata(ctx context.Context, tc *TrackerClient, storeServ *StorageServer,
+	remoteFilename string) (*GetMetadataResponse, error) {
+	var (
+		conn     net.Conn
+		reqBuf   []byte
+		recvBuff []byte
+		err      error
+	)
+
+	conn, err = this.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := &getMetadataRequest{}
+	req.groupName = storeServ.groupName
+	req.remoteFilename = remoteFilename
+	reqBuf, err = req.marshal()
+	if err != nil {
+		this.pool.logger.Warnf("getMetadataRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_GET_METADATA
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		return nil, Errno{int(th.status)}
+	}
+	if th.pkgLen > 0 {
+		recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
+		if err != nil {
+			this.pool.logger.Warnf("TcpRecvResponse error :%s", err.Error())
+			return nil, err
+		}
+	}
+
+	mr := &GetMetadataResponse{}
+	if err = mr.unmarshal(recvBuff); err != nil {
+		return nil, err
+	}
+	mr.RemoteFileId = joinFileId(storeServ.groupName, remoteFilename)
+	return mr, nil
+}
+
+// storageSetUploadMetadata stores metaData on the file just uploaded to storeServ.
+// With rollback set, a failure deletes that file so it never exists without its metadata;
+// otherwise ur is returned along with the error so the caller can still find the file.
+func (this *StorageClient) storageSetUploadMetadata(ctx context.Context, tc *TrackerClient, storeServ *StorageServer,
+	ur *UploadFileResponse, metaData map[string]string, rollback bool) (*UploadFileResponse, error) {
+	fileServ := *storeServ
+	fileServ.groupName = ur.GroupName
+	remoteFilename := strings.TrimPrefix(ur.RemoteFileId, ur.GroupName+"/")
+
+	err := this.storageSetMetadata(ctx, tc, &fileServ, remoteFilename, metaData, STORAGE_SET_METADATA_FLAG_OVERWRITE)
+	if err == nil {
+		return ur, nil
+	}
+	this.pool.logger.Warnf("set metadata of %s error :%s", ur.RemoteFileId, err.Error())
+	if rollback {
+		// clean up even when ctx is what made the metadata step fail
+		if _, delErr := this.storageDeleteFile(context.Background(), tc, &fileServ, remoteFilename); delErr != nil {
+			this.pool.logger.Errorf("rollback of %s error :%s", ur.RemoteFileId, delErr.Error())
+			return ur, fmt.Errorf("%s (rollback failed: %s)", err.Error(), delErr.Error())
+		}
+		return nil, err
+	}
+	return ur, err
+}
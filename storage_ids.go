@@ -0,0 +1,124 @@
+package fdfs_client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StorageIdInfo is one line of storage_ids.conf.
+type StorageIdInfo struct {
+	Id        string
+	GroupName string
+	IpAddrs   []string // the first one is used, the others are alternatives
+	Port      int      // 0 unless the line gives one
+}
+
+func (this *StorageIdInfo) IpAddr() string {
+	return this.IpAddrs[0]
+}
+
+// StorageIds maps the storage ids of a cluster running with use_storage_id=true
+// to their servers and back.
+type StorageIds struct {
+	byId map[string]*StorageIdInfo
+	byIp map[string]*StorageIdInfo
+}
+
+// LoadStorageIds reads a storage_ids.conf with lines of the form
+//
+//	<id> <group_name> <ip_or_hostname[,ip_or_hostname...][:port]>
+//
+// as used by the FastDFS trackers.
+func LoadStorageIds(filename string) (*StorageIds, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ids := &StorageIds{
+		byId: make(map[string]*StorageIdInfo),
+		byIp: make(map[string]*StorageIdInfo),
+	}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		info, err := parseStorageIdLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineNo, err.Error())
+		}
+		if _, ok := ids.byId[info.Id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate storage id %s", filename, lineNo, info.Id)
+		}
+		ids.byId[info.Id] = info
+		for _, ipAddr := range info.IpAddrs {
+			ids.byIp[ipAddr] = info
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func parseStorageIdLine(line string) (*StorageIdInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("expect <id> <group_name> <ip[:port]>, got %q", line)
+	}
+	info := &StorageIdInfo{Id: fields[0], GroupName: fields[1]}
+	if id, err := strconv.Atoi(info.Id); err != nil || id <= 0 || id > FDFS_MAX_SERVER_ID {
+		return nil, fmt.Errorf("invalid storage id %q", info.Id)
+	}
+	if len(info.GroupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return nil, fmt.Errorf("group name %q too long", info.GroupName)
+	}
+	addrs := fields[2]
+	if host, port, err := net.SplitHostPort(addrs); err == nil {
+		if info.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port in %q", addrs)
+		}
+		addrs = host
+	}
+	for _, ipAddr := range strings.Split(addrs, ",") {
+		if ipAddr = strings.TrimSpace(ipAddr); ipAddr != "" {
+			info.IpAddrs = append(info.IpAddrs, ipAddr)
+		}
+	}
+	if len(info.IpAddrs) == 0 {
+		return nil, fmt.Errorf("no ip address in %q", line)
+	}
+	return info, nil
+}
+
+func (this *StorageIds) ById(id string) (*StorageIdInfo, bool) {
+	info, ok := this.byId[id]
+	return info, ok
+}
+
+func (this *StorageIds) ByIp(ipAddr string) (*StorageIdInfo, bool) {
+	info, ok := this.byIp[ipAddr]
+	return info, ok
+}
+
+// resolve returns the id for storageId given as an id or an IP address of
+// groupName, or storageId itself when the table does not know it.
+func (this *StorageIds) resolve(groupName string, storageId string) string {
+	if this == nil {
+		return storageId
+	}
+	if _, ok := this.byId[storageId]; ok {
+		return storageId
+	}
+	if info, ok := this.byIp[storageId]; ok && (groupName == "" || info.GroupName == groupName) {
+		return info.Id
+	}
+	return storageId
+}
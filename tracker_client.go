@@ -2,7 +2,10 @@ package fdfs_client
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"net"
 )
 
@@ -10,14 +13,14 @@ type TrackerClient struct {
 	pool *ConnectionPool
 }
 
-func (this *TrackerClient) trackerQueryStorageStorWithoutGroup() (*StorageServer, error) {
+func (this *TrackerClient) trackerQueryStorageStorWithoutGroup(ctx context.Context) (*StorageServer, error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
 		err      error
 	)
 
-	conn, err = this.pool.Get()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -25,9 +28,13 @@ func (this *TrackerClient) trackerQueryStorageStorWithoutGroup() (*StorageServer
 
 	th := &trackerHeader{}
 	th.cmd = TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
 		return nil, Errno{int(th.status)}
 	}
@@ -40,7 +47,7 @@ func (this *TrackerClient) trackerQueryStorageStorWithoutGroup() (*StorageServer
 	)
 	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
 	if err != nil {
-		logger.Warnf("TcpRecvResponse error :%s", err.Error())
+		this.pool.logger.Warnf("TcpRecvResponse error :%s", err.Error())
 		return nil, err
 	}
 	buff := bytes.NewBuffer(recvBuff)
@@ -52,23 +59,25 @@ func (this *TrackerClient) trackerQueryStorageStorWithoutGroup() (*StorageServer
 	return &StorageServer{ipAddr, int(port), groupName, int(storePathIndex)}, nil
 }
 
-func (this *TrackerClient) trackerQueryStorageStorWithGroup(groupName string) (*StorageServer, error) {
+func (this *TrackerClient) trackerQueryStorageStorWithGroup(ctx context.Context, groupName string) (*StorageServer, error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
 		err      error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
 	th := &trackerHeader{}
 	th.cmd = TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE
 	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN)
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
 	groupBuffer := new(bytes.Buffer)
 	// 16 bit groupName
@@ -87,9 +96,11 @@ func (this *TrackerClient) trackerQueryStorageStorWithGroup(groupName string) (*
 		return nil, err
 	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
-		logger.Warnf("recvHeader error [%d]", th.status)
+		this.pool.logger.Warnf("recvHeader error [%d]", th.status)
 		return nil, Errno{int(th.status)}
 	}
 
@@ -100,7 +111,7 @@ func (this *TrackerClient) trackerQueryStorageStorWithGroup(groupName string) (*
 	)
 	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
 	if err != nil {
-		logger.Warnf("TcpRecvResponse error :%s", err.Error())
+		this.pool.logger.Warnf("TcpRecvResponse error :%s", err.Error())
 		return nil, err
 	}
 	buff := bytes.NewBuffer(recvBuff)
@@ -112,31 +123,33 @@ func (this *TrackerClient) trackerQueryStorageStorWithGroup(groupName string) (*
 	return &StorageServer{ipAddr, int(port), groupName, int(storePathIndex)}, nil
 }
 
-func (this *TrackerClient) trackerQueryStorageUpdate(groupName string, remoteFilename string) (*StorageServer, error) {
-	return this.trackerQueryStorage(groupName, remoteFilename, TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE)
+func (this *TrackerClient) trackerQueryStorageUpdate(ctx context.Context, groupName string, remoteFilename string) (*StorageServer, error) {
+	return this.trackerQueryStorage(ctx, groupName, remoteFilename, TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE)
 }
 
-func (this *TrackerClient) trackerQueryStorageFetch(groupName string, remoteFilename string) (*StorageServer, error) {
-	return this.trackerQueryStorage(groupName, remoteFilename, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE)
+func (this *TrackerClient) trackerQueryStorageFetch(ctx context.Context, groupName string, remoteFilename string) (*StorageServer, error) {
+	return this.trackerQueryStorage(ctx, groupName, remoteFilename, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE)
 }
 
-func (this *TrackerClient) trackerQueryStorage(groupName string, remoteFilename string, cmd int8) (*StorageServer, error) {
+func (this *TrackerClient) trackerQueryStorage(ctx context.Context, groupName string, remoteFilename string, cmd int8) (*StorageServer, error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
 		err      error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
 	th := &trackerHeader{}
 	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + len(remoteFilename))
 	th.cmd = cmd
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
 	// #query_fmt: |-group_name(16)-filename(file_name_len)-|
 	queryBuffer := new(bytes.Buffer)
@@ -159,9 +172,11 @@ func (this *TrackerClient) trackerQueryStorage(groupName string, remoteFilename
 		return nil, err
 	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
-		logger.Warnf("recvHeader error [%d]", th.status)
+		this.pool.logger.Warnf("recvHeader error [%d]", th.status)
 		return nil, Errno{int(th.status)}
 	}
 
@@ -172,7 +187,7 @@ func (this *TrackerClient) trackerQueryStorage(groupName string, remoteFilename
 	)
 	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
 	if err != nil {
-		logger.Warnf("TcpRecvResponse error :%s", err.Error())
+		this.pool.logger.Warnf("TcpRecvResponse error :%s", err.Error())
 		return nil, err
 	}
 	buff := bytes.NewBuffer(recvBuff)
@@ -183,3 +198,163 @@ func (this *TrackerClient) trackerQueryStorage(groupName string, remoteFilename
 	binary.Read(buff, binary.BigEndian, &storePathIndex)
 	return &StorageServer{ipAddr, int(port), groupName, int(storePathIndex)}, nil
 }
+
+// trackerRequest sends cmd with body to a tracker and returns the response body.
+func (this *TrackerClient) trackerRequest(ctx context.Context, cmd int8, body []byte) ([]byte, error) {
+	conn, err := this.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	th := &trackerHeader{}
+	th.pkgLen = int64(len(body))
+	th.cmd = cmd
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		if err = TcpSendData(conn, body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		this.pool.logger.Warnf("recvHeader error [%d]", th.status)
+		return nil, Errno{int(th.status)}
+	}
+
+	recvBuff, recvSize, err := TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		this.pool.logger.Warnf("TcpRecvResponse error :%s", err.Error())
+		return nil, err
+	}
+	if recvSize != th.pkgLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return recvBuff, nil
+}
+
+func (this *TrackerClient) trackerListGroups(ctx context.Context) ([]GroupStat, error) {
+	recvBuff, err := this.trackerRequest(ctx, TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS, nil)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalGroupStats(recvBuff)
+}
+
+func (this *TrackerClient) trackerListGroup(ctx context.Context, groupName string) (*GroupStat, error) {
+	// #list_fmt: |-group_name(16)-|
+	buffer := new(bytes.Buffer)
+	writeFixedString(buffer, groupName, FDFS_GROUP_NAME_MAX_LEN)
+	recvBuff, err := this.trackerRequest(ctx, TRACKER_PROTO_CMD_SERVER_LIST_ONE_GROUP, buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	stats, err := unmarshalGroupStats(recvBuff)
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) != 1 {
+		return nil, fmt.Errorf("tracker returned %d groups, want 1", len(stats))
+	}
+	return &stats[0], nil
+}
+
+func (this *TrackerClient) trackerListStorages(ctx context.Context, groupName string, storageId string) ([]StorageStat, error) {
+	// the tracker keeps the id NUL terminated
+	if len(storageId) >= FDFS_STORAGE_ID_MAX_SIZE {
+		return nil, fmt.Errorf("storage id %q longer than %d", storageId, FDFS_STORAGE_ID_MAX_SIZE-1)
+	}
+	// #list_fmt: |-group_name(16)-storage_id(id_len)-|
+	buffer := new(bytes.Buffer)
+	writeFixedString(buffer, groupName, FDFS_GROUP_NAME_MAX_LEN)
+	buffer.WriteString(storageId)
+	recvBuff, err := this.trackerRequest(ctx, TRACKER_PROTO_CMD_SERVER_LIST_STORAGE, buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalStorageStats(recvBuff)
+}
+
+func (this *TrackerClient) trackerDeleteStorage(ctx context.Context, groupName string, storageId string) error {
+	// the tracker keeps the id NUL terminated
+	if len(storageId) >= FDFS_STORAGE_ID_MAX_SIZE {
+		return fmt.Errorf("storage id %q longer than %d", storageId, FDFS_STORAGE_ID_MAX_SIZE-1)
+	}
+	// #del_fmt: |-group_name(16)-storage_id(id_len)-|
+	buffer := new(bytes.Buffer)
+	writeFixedString(buffer, groupName, FDFS_GROUP_NAME_MAX_LEN)
+	buffer.WriteString(storageId)
+	_, err := this.trackerRequest(ctx, TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE, buffer.Bytes())
+	return err
+}
+
+func (this *TrackerClient) trackerQueryStorageFetchAll(ctx context.Context, groupName string, remoteFilename string) ([]StorageServer, error) {
+	// #query_fmt: |-group_name(16)-filename(file_name_len)-|
+	buffer := new(bytes.Buffer)
+	writeFixedString(buffer, groupName, FDFS_GROUP_NAME_MAX_LEN)
+	buffer.WriteString(remoteFilename)
+	recvBuff, err := this.trackerRequest(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL, buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-[ipaddr(16-1)]...-|
+	extra := len(recvBuff) - TRACKER_QUERY_STORAGE_FETCH_BODY_LEN
+	if extra < 0 || extra%(IP_ADDRESS_SIZE-1) != 0 {
+		return nil, fmt.Errorf("invalid fetch storage list length %d", len(recvBuff))
+	}
+	var port int64
+	buff := bytes.NewBuffer(recvBuff)
+	groupName, _ = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
+	ipAddr, _ := readCstr(buff, IP_ADDRESS_SIZE-1)
+	binary.Read(buff, binary.BigEndian, &port)
+	storages := []StorageServer{{ipAddr, int(port), groupName, 0}}
+	for buff.Len() > 0 {
+		ipAddr, _ = readCstr(buff, IP_ADDRESS_SIZE-1)
+		storages = append(storages, StorageServer{ipAddr, int(port), groupName, 0})
+	}
+	return storages, nil
+}
+
+// trackerQueryStorageStorAll returns every storage server that accepts uploads,
+// within groupName or, when it is empty, within the group the tracker chooses.
+func (this *TrackerClient) trackerQueryStorageStorAll(ctx context.Context, groupName string) ([]StorageServer, error) {
+	var (
+		recvBuff []byte
+		err      error
+	)
+	if groupName == "" {
+		recvBuff, err = this.trackerRequest(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ALL, nil)
+	} else {
+		// #query_fmt: |-group_name(16)-|
+		buffer := new(bytes.Buffer)
+		writeFixedString(buffer, groupName, FDFS_GROUP_NAME_MAX_LEN)
+		recvBuff, err = this.trackerRequest(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ALL, buffer.Bytes())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// #recv_fmt |-group_name(16)-[ipaddr(16-1)-port(8)]...-store_path_index(1)|
+	const serverLen = IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE
+	serversLen := len(recvBuff) - FDFS_GROUP_NAME_MAX_LEN - 1
+	if serversLen < serverLen || serversLen%serverLen != 0 {
+		return nil, fmt.Errorf("invalid store storage list length %d", len(recvBuff))
+	}
+	storePathIndex := int(recvBuff[len(recvBuff)-1])
+	buff := bytes.NewBuffer(recvBuff[:len(recvBuff)-1])
+	groupName, _ = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
+	storages := make([]StorageServer, 0, serversLen/serverLen)
+	for buff.Len() > 0 {
+		var port int64
+		ipAddr, _ := readCstr(buff, IP_ADDRESS_SIZE-1)
+		binary.Read(buff, binary.BigEndian, &port)
+		storages = append(storages, StorageServer{ipAddr, int(port), groupName, storePathIndex})
+	}
+	return storages, nil
+}
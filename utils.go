@@ -3,12 +3,14 @@ package fdfs_client
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,17 +27,25 @@ type Errno struct {
 	status int
 }
 
-type fileInfo struct {
-	createTimeStamp int32
-	crc32           int32
-	sourceId        int
-	fileSize        int64
-	sourceIpAddress string
+// FileInfo describes a file stored in FastDFS.
+type FileInfo struct {
+	FileSize        int64
+	CreateTime      time.Time
+	Crc32           uint32
+	SourceIpAddr    string // storage server the file was uploaded to
+	SourceStorageId string // set when the file id carries a storage id instead of an IP address
+	IsAppender      bool
+	IsTrunk         bool // stored inside a trunk file
+	IsSlave         bool
 }
 
 func (e Errno) Error() string {
 	errmsg := fmt.Sprintf("errno [%d] ", e.status)
 	switch e.status {
+	case 2:
+		errmsg += "No Such File Or Server"
+	case 16:
+		errmsg += "Device Or Resource Busy"
 	case 17:
 		errmsg += "File Exist"
 	case 22:
@@ -61,6 +71,20 @@ func fdfsCheckFile(filename string) error {
 	return nil
 }
 
+// openUploadFile opens filename for streaming and returns its size.
+func openUploadFile(filename string) (*os.File, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, fileInfo.Size(), nil
+}
+
 func readCstr(buff io.Reader, length int) (string, error) {
 	str := make([]byte, length)
 	n, err := buff.Read(str)
@@ -76,95 +100,186 @@ func readCstr(buff io.Reader, length int) (string, error) {
 	}
 	return string(str), nil
 }
-func getFileExt(filename string) string {
-	parts := strings.Split(filename, ".")
-	if len(parts) >= 2 {
-		return parts[len(parts)-1]
+
+// verifyLocalFile checks the size of a downloaded file against the storage
+// server's file info, and its CRC32 too if checkCrc32 is set.
+func verifyLocalFile(file *os.File, info *FileInfo, checkCrc32 bool) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
 	}
-	return ""
+	if size != info.FileSize {
+		return fmt.Errorf("size of %s is %d, storage server has %d", file.Name(), size, info.FileSize)
+	}
+	if sum := hash.Sum32(); checkCrc32 && sum != info.Crc32 {
+		return &ErrChecksumMismatch{RemoteFileId: file.Name(), Expected: info.Crc32, Actual: sum}
+	}
+	return nil
 }
 
-func splitRemoteFileId(remoteFileId string) ([]string, error) {
-	parts := strings.SplitN(remoteFileId, "/", 2)
-	if len(parts) < 2 {
-		return nil, errors.New("error remoteFileId")
-	}
-	return parts, nil
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
 }
-func inet_ntoa(bytes []byte) (string, error) {
-	if len(bytes) != 4 {
-		return "", errors.New("error ip address")
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += int64(n)
+	return n, err
+}
+
+// replayableReader lets an upload retry resend the bytes of a reader. A seekable
+// reader is rewound to where the first try started; any other reader can only
+// be retried while nothing has been read from it.
+type replayableReader struct {
+	reader  io.Reader
+	seeker  io.Seeker
+	start   int64
+	counter *countingReader
+}
+
+func newReplayableReader(r io.Reader) *replayableReader {
+	if seeker, ok := r.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return &replayableReader{reader: r, seeker: seeker, start: start}
+		}
 	}
+	counter := &countingReader{r: r}
+	return &replayableReader{reader: counter, counter: counter}
+}
 
-	return net.IPv4(bytes[0], bytes[1], bytes[2], bytes[3]).String(), nil
+func (this *replayableReader) canReplay() bool {
+	return this.seeker != nil || this.counter.n == 0
 }
 
-func (this *FdfsClient) getFileInfo(remotFileId string) (*fileInfo, error) {
-	parts, err := splitRemoteFileId(remotFileId)
-	if err != nil {
-		return nil, err
-	}
-	fileLen := len(parts[1])
-	if fileLen < FDFS_NORMAL_LOGIC_FILENAME_LENGTH {
-		return nil, errors.New("error remoteFileName")
-	}
-	fileInfo := &fileInfo{}
-	var buffer bytes.Buffer
-	buffer.WriteString(parts[1][FDFS_LOGIC_FILE_PATH_LEN : FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH])
-	buffer.WriteString("=")
-	logger.Info(buffer.String())
-	decode, err := coder.DecodeString(buffer.String())
-	if err != nil {
-		return nil, err
+// replay rewinds the reader before a try.
+func (this *replayableReader) replay() error {
+	if this.seeker == nil {
+		return nil
 	}
-	ip, err := inet_ntoa(decode[:4])
-	if err != nil {
-		return nil, err
+	_, err := this.seeker.Seek(this.start, io.SeekStart)
+	return err
+}
+
+// cstr returns the zero terminated string stored in a fixed size field.
+func cstr(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
 	}
-	fileInfo.sourceIpAddress = ip
+	return string(field)
+}
 
-	b_buf := bytes.NewBuffer(decode[4:])
+// unixTime converts a protocol timestamp, where 0 means never, to a time.Time.
+func unixTime(sec int64) time.Time {
+	if sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
 
-	var (
-		createTimeStamp int32
-		crc32           int32
-		//sourceId        int
-		fileSize int64
-	)
+// writeFixedString writes str into buffer as a zero padded field of length bytes.
+func writeFixedString(buffer *bytes.Buffer, str string, length int) {
+	strBytes := []byte(str)
+	for i := 0; i < length; i++ {
+		if i >= len(strBytes) {
+			buffer.WriteByte(byte(0))
+		} else {
+			buffer.WriteByte(strBytes[i])
+		}
+	}
+}
 
-	if err = binary.Read(b_buf, binary.BigEndian, &createTimeStamp); err != nil {
-		logger.Error("1")
-		return nil, err
+// packMetadata encodes metaData as name\x02value records joined by \x01,
+// sorted by name so the same map always yields the same bytes.
+func packMetadata(metaData map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(metaData))
+	for name, value := range metaData {
+		if name == "" {
+			return nil, errors.New("metadata name is empty")
+		}
+		if len(name) > FDFS_MAX_META_NAME_LEN {
+			return nil, fmt.Errorf("metadata name %q longer than %d bytes", name, FDFS_MAX_META_NAME_LEN)
+		}
+		if len(value) > FDFS_MAX_META_VALUE_LEN {
+			return nil, fmt.Errorf("metadata value of %q longer than %d bytes", name, FDFS_MAX_META_VALUE_LEN)
+		}
+		if strings.ContainsAny(name+value, string([]byte{FDFS_RECORD_SEPERATOR, FDFS_FIELD_SEPERATOR})) {
+			return nil, fmt.Errorf("metadata %q contains a reserved separator", name)
+		}
+		names = append(names, name)
 	}
-	if err = binary.Read(b_buf, binary.BigEndian, &fileSize); err != nil {
-		logger.Error("2")
-		return nil, err
+	sort.Strings(names)
+
+	buffer := new(bytes.Buffer)
+	for i, name := range names {
+		if i > 0 {
+			buffer.WriteByte(FDFS_RECORD_SEPERATOR)
+		}
+		buffer.WriteString(name)
+		buffer.WriteByte(FDFS_FIELD_SEPERATOR)
+		buffer.WriteString(metaData[name])
 	}
-	if err = binary.Read(b_buf, binary.BigEndian, &crc32); err != nil {
-		logger.Error("3")
-		return nil, err
+	return buffer.Bytes(), nil
+}
+
+func unpackMetadata(data []byte) (map[string]string, error) {
+	metaData := make(map[string]string)
+	if len(data) == 0 {
+		return metaData, nil
 	}
-	//logger.Infof("filesize:%ld", fileSize)
-	if (fileSize >> 63) == 0 {
-		fileSize &= 0x00000000FFFFFFFF
+	for _, record := range strings.Split(string(data), string(FDFS_RECORD_SEPERATOR)) {
+		fields := strings.SplitN(record, string(FDFS_FIELD_SEPERATOR), 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("error metadata record %q", record)
+		}
+		metaData[fields[0]] = fields[1]
 	}
-	//logger.Infof("filesize:%ld", fileSize)
-	if (fileSize >> 57) != 0 {
-		logger.Info("appender file")
-		return this.QueryFileInfo(parts[0], parts[1])
+	return metaData, nil
+}
 
-	} else {
-		logger.Info("not appender file")
+func getFileExt(filename string) string {
+	return strings.TrimPrefix(filepath.Ext(filename), ".")
+}
+
+func inet_ntoa(bytes []byte) (string, error) {
+	if len(bytes) != 4 {
+		return "", errors.New("error ip address")
 	}
-	fileInfo.createTimeStamp = createTimeStamp
-	fileInfo.crc32 = crc32
-	return fileInfo, nil
 
+	return net.IPv4(bytes[0], bytes[1], bytes[2], bytes[3]).String(), nil
+}
+
+// parseRemoteFilename decodes the file info the storage server encodes in a
+// remote filename.
+func parseRemoteFilename(remoteFilename string) (*FileInfo, error) {
+	id, err := parseFilename(remoteFilename)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote filename %q: %s", remoteFilename, err.Error())
+	}
+	return id.fileInfo(), nil
 }
-func (fileInfo *fileInfo) Print() {
 
-	logger.Info("createtime:" + time.Unix(int64(fileInfo.createTimeStamp), 0).String())
-	logger.Infof("crc:%d", fileInfo.crc32)
-	logger.Info("source ip:" + fileInfo.sourceIpAddress)
-	logger.Infof("filesize:%d", fileInfo.fileSize)
+func (this *FileInfo) String() string {
+	source := this.SourceIpAddr
+	if this.SourceStorageId != "" {
+		source = "storage " + this.SourceStorageId
+	}
+	return fmt.Sprintf("size:%d create time:%s crc32:%08x source:%s appender:%t trunk:%t slave:%t",
+		this.FileSize, this.CreateTime.Format(time.RFC3339), this.Crc32, source, this.IsAppender, this.IsTrunk, this.IsSlave)
 }